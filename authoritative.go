@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain - maximum number of CNAME records followed for a single query
+const maxCNAMEChain = 8
+
+// errCNAMELoop - returned by authoritativeAnswer for CNAME chains that loop or
+// exceed maxCNAMEChain
+var errCNAMELoop = errors.New("CNAME chain loops or is too long")
+
+// getCachedRecords returns the records under name in domain, falling back to a
+// MySQL lookup (and caching the result) when the name isn't cached yet or its
+// records expired. Expired records are served stale when the lookup fails
+// and refreshed in the background, popular ones are prefetched before they
+// expire
+func getCachedRecords(name string, domain Domain) ([]Record, error) {
+	set := records.GetRecordsByName(name, domain.ID)
+	if len(set) == 0 {
+		// names missing from the zone's index don't exist, MySQL has nothing
+		if exists, _, err := zoneNames.Lookup(name, domain); err == nil && !exists {
+			return nil, nil
+		}
+	}
+	key := fmt.Sprintf("%s.%s", name, domain.Name)
+	if len(set) > 0 && (!staleSet(set) || refreshing(key)) {
+		if shouldPrefetch(set) {
+			prefetch(key, "uberdns", func() error {
+				_, err := loadRecords(name, domain)
+				return err
+			})
+		}
+		return set, nil
+	}
+
+	fresh, err := loadRecords(name, domain)
+	if err != nil && len(set) > 0 {
+		logger("dns").Warning(fmt.Sprintf("Serving stale records for %s: %s", key, err.Error()))
+		refreshInBackground(key, func() error {
+			_, err := loadRecords(name, domain)
+			return err
+		})
+		return set, nil
+	}
+	return fresh, err
+}
+
+// loadRecords looks the records under name in domain up in MySQL and caches
+// them in place of the cached set. A name is loaded with all of its types, so
+// concurrent loads of it share a single query
+func loadRecords(name string, domain Domain) ([]Record, error) {
+	set, err := mysqlLookups.Do(fmt.Sprintf("%d/%s", domain.ID, strings.ToLower(name)), func() (interface{}, error) {
+		return cacheRecordsFromHost(name, domain)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set.([]Record), nil
+}
+
+// cacheRecordsFromHost performs the MySQL lookup of loadRecords
+func cacheRecordsFromHost(name string, domain Domain) ([]Record, error) {
+	//No existing records found in local cache, perform sql lookup
+	set, err := getRecordsFromHost(name, domain.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(set) > 0 {
+		logger("dns").Debug(fmt.Sprintf("Adding record %s.%s to cache", name, domain.Name))
+	}
+	for i := range set {
+		set[i].DOB = time.Now()
+	}
+	reindexName(name, domain, set)
+	// a popular name being prefetched keeps being answered from its old set
+	// until the new one is in place
+	replaceCachedSet(domain.ID, name, set, records)
+
+	return set, nil
+}
+
+// authoritativeAnswer fills msg with the answer for a query against one of our
+// zones. CNAMEs are followed through our own zones and out-of-zone targets are
+// handed to recursiveAnswer, so the full chain is returned on every lookup.
+// Names without records get NXDOMAIN and names without records of the
+// queried type NODATA, a failed lookup sets SERVFAIL and returns its error.
+// ANY queries are answered with a single RRset (RFC 8482)
+func authoritativeAnswer(msg *dns.Msg, fqdn string, qtype uint16, subdomain string, domain Domain) error {
+	seen := make(map[string]bool)
+
+	for {
+		// SOA and NS live on the dns_domain row rather than in dns_record, a
+		// zone without nameservers answers NS with NODATA below
+		if subdomain == apexName {
+			switch ns := domain.nsRRs(); {
+			case qtype == dns.TypeSOA || qtype == dns.TypeANY:
+				msg.Answer = append(msg.Answer, domain.soaRR())
+				return nil
+			case qtype == dns.TypeNS && len(ns) > 0:
+				msg.Answer = append(msg.Answer, ns...)
+				for i := range ns {
+					msg.Extra = append(msg.Extra, glueRecords(ns[i].(*dns.NS).Ns)...)
+				}
+				return nil
+			}
+		}
+
+		set, err := getCachedRecords(subdomain, domain)
+		// the apex always exists through its SOA
+		exists := len(set) > 0 || subdomain == apexName
+		if err == nil && !exists {
+			set, exists, err = matchWildcard(subdomain, domain)
+		}
+		if err != nil {
+			msg.Rcode = dns.RcodeServerFailure
+			return err
+		}
+		if staleSet(set) {
+			markStale(msg)
+		}
+
+		// a CNAME can't coexist with other data, so it is the only record in its set
+		var cname Record
+		for i := range set {
+			if set[i].Type == recordTypeCNAME {
+				cname = set[i]
+			}
+		}
+
+		if (Record{}) == cname {
+			rrtype := qtype
+			if qtype == dns.TypeANY {
+				rrtype = anyRRsetType(set)
+			}
+
+			var answers []dns.RR
+			for i := range set {
+				answers = append(answers, recordToRR(fqdn, rrtype, set[i])...)
+			}
+			msg.Answer = append(msg.Answer, orderRRset(normalizeTTL(answers))...)
+
+			if len(answers) == 0 {
+				if !exists {
+					msg.Rcode = dns.RcodeNameError
+				}
+				msg.Ns = append(msg.Ns, domain.negativeSOA())
+				return nil
+			}
+
+			for i := range msg.Answer {
+				switch rr := msg.Answer[i].(type) {
+				case *dns.MX:
+					msg.Extra = append(msg.Extra, glueRecords(rr.Mx)...)
+				case *dns.SRV:
+					msg.Extra = append(msg.Extra, glueRecords(rr.Target)...)
+				}
+			}
+			return nil
+		}
+
+		msg.Answer = append(msg.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: fqdn, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: cname.remainingTTL()},
+			Target: dns.Fqdn(cname.Target),
+		})
+		if qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+			return nil
+		}
+
+		seen[strings.ToLower(fqdn)] = true
+		fqdn = dns.Fqdn(cname.Target)
+		if seen[strings.ToLower(fqdn)] || len(seen) > maxCNAMEChain {
+			logger("dns").Warning(fmt.Sprintf("CNAME loop detected while resolving %s", fqdn))
+			msg.Rcode = dns.RcodeServerFailure
+			return errCNAMELoop
+		}
+
+		subdomain, domain = findZone(fqdn)
+		if (Domain{}) == domain {
+			// target lives outside of our zones, finish the chain through the
+			// recursive cache like any other out-of-zone question
+			return recursiveAnswer(msg, fqdn, qtype, dns.ClassINET)
+		}
+	}
+}
+
+// anyRRsetType picks the type of the single RRset answering an ANY query,
+// the type of the first record in the set
+func anyRRsetType(set []Record) uint16 {
+	for _, device := range set {
+		switch {
+		case device.isAddress() && device.IP != "":
+			return dns.TypeA
+		case device.isAddress() && device.IPv6 != "":
+			return dns.TypeAAAA
+		case !device.isAddress():
+			return dns.StringToType[device.Type]
+		}
+	}
+	return dns.TypeNone
+}
+
+// matchWildcard returns the records answering name through the wildcard at
+// its closest encloser (RFC 4592), for names without records of their own.
+// The bool reports whether name exists at all - either as an empty
+// non-terminal, which never matches a wildcard, or through a wildcard match
+func matchWildcard(name string, domain Domain) ([]Record, bool, error) {
+	_, below, err := nameState(name, domain)
+	if err != nil || below {
+		return nil, below, err
+	}
+
+	labels := strings.Split(name, ".")
+	for i := 1; i <= len(labels); i++ {
+		// the closest encloser is the nearest ancestor that exists, the apex always does
+		encloser := strings.Join(labels[i:], ".")
+		if encloser != "" {
+			exists, below, err := nameState(encloser, domain)
+			if err != nil {
+				return nil, false, err
+			}
+			if !exists && !below {
+				continue
+			}
+		}
+
+		wildcard := "*"
+		if encloser != "" {
+			wildcard = "*." + encloser
+		}
+		set, err := getCachedRecords(wildcard, domain)
+		if len(set) > 0 {
+			logger("dns").Debug(fmt.Sprintf("%s matched wildcard %s.%s", name, wildcard, domain.Name))
+		}
+		return set, len(set) > 0, err
+	}
+
+	return nil, false, nil
+}
+
+// glueRecords returns the A/AAAA records of an MX exchange or SRV target when
+// it lives in one of our zones, used to populate the additional section. Glue
+// is optional so lookup failures just leave it out
+func glueRecords(target string) []dns.RR {
+	subdomain, domain := findZone(target)
+	if (Domain{}) == domain {
+		return nil
+	}
+
+	set, _ := getCachedRecords(subdomain, domain)
+
+	var extra []dns.RR
+	for _, device := range set {
+		extra = append(extra, recordToRR(target, dns.TypeA, device)...)
+		extra = append(extra, recordToRR(target, dns.TypeAAAA, device)...)
+	}
+	return extra
+}
+
+// recordToRR converts a record into the resource records answering qtype,
+// records with nothing to offer for qtype return no RRs (NODATA)
+func recordToRR(fqdn string, qtype uint16, device Record) []dns.RR {
+	switch qtype {
+	case dns.TypeA:
+		if device.isAddress() && device.IP != "" {
+			return []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: device.remainingTTL()},
+				A:   net.ParseIP(device.IP),
+			}}
+		}
+	case dns.TypeAAAA:
+		if device.isAddress() && device.IPv6 != "" {
+			return []dns.RR{&dns.AAAA{
+				Hdr:  dns.RR_Header{Name: fqdn, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: device.remainingTTL()},
+				AAAA: net.ParseIP(device.IPv6),
+			}}
+		}
+	case dns.TypeMX:
+		if device.Type == recordTypeMX {
+			return []dns.RR{&dns.MX{
+				Hdr:        dns.RR_Header{Name: fqdn, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: device.remainingTTL()},
+				Preference: uint16(device.Priority),
+				Mx:         dns.Fqdn(device.Target),
+			}}
+		}
+	case dns.TypeSRV:
+		if device.Type == recordTypeSRV {
+			return []dns.RR{&dns.SRV{
+				Hdr:      dns.RR_Header{Name: fqdn, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: device.remainingTTL()},
+				Priority: uint16(device.Priority),
+				Weight:   uint16(device.Weight),
+				Port:     uint16(device.Port),
+				Target:   dns.Fqdn(device.Target),
+			}}
+		}
+	case dns.TypeTXT:
+		if device.Type == recordTypeTXT {
+			return []dns.RR{&dns.TXT{
+				Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: device.remainingTTL()},
+				Txt: txtStrings(device.Text),
+			}}
+		}
+	}
+	return nil
+}
+
+// txtStrings splits TXT content into the character-strings of the RR. Content
+// made of "quoted" "strings" yields one string per quoted value, anything else
+// is a single value. Values longer than 255 bytes are split into consecutive
+// strings, which is how SPF/DKIM consumers expect to reassemble them
+func txtStrings(content string) []string {
+	var values []string
+	trimmed := strings.TrimSpace(content)
+	if strings.HasPrefix(trimmed, "\"") {
+		var value []byte
+		quoted := false
+		for i := 0; i < len(trimmed); i++ {
+			switch c := trimmed[i]; {
+			case c == '"':
+				if quoted {
+					values = append(values, string(value))
+					value = value[:0]
+				}
+				quoted = !quoted
+			case c == '\\' && quoted && i+1 < len(trimmed):
+				i++
+				value = append(value, trimmed[i])
+			case quoted:
+				value = append(value, c)
+			}
+		}
+		// tolerate a missing closing quote
+		if quoted {
+			values = append(values, string(value))
+		}
+	} else {
+		values = append(values, content)
+	}
+
+	var txt []string
+	for _, value := range values {
+		for len(value) > 255 {
+			txt = append(txt, escapeTXT(value[:255]))
+			value = value[255:]
+		}
+		txt = append(txt, escapeTXT(value))
+	}
+	return txt
+}
+
+// escapeTXT escapes backslashes, the dns package reads them as escape
+// sequences when packing character-strings
+func escapeTXT(s string) string {
+	return strings.Replace(s, "\\", "\\\\", -1)
+}
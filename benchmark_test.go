@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"sync"
 	"testing"
+	"time"
 )
 
 var benchRecords RecordMap
@@ -12,10 +14,12 @@ var purgeChannel = make(chan Record)
 func BenchmarkCreateCachedRecords(b *testing.B) {
 	benchRecords.mu = new(sync.Mutex)
 	benchRecords.Records = make(map[int]Record)
+	benchRecords.names = make(map[string][]int)
+	benchRecords.expiry = newExpiryScheduler(purgeChannel)
 	for i := 0; i < b.N; i++ {
 		var record = new(Record)
 		record.TTL = 0
-		go addRecordToCache(*record, benchRecords, recordChannel, purgeChannel)
+		go addRecordToCache(*record, benchRecords, recordChannel)
 		<-recordChannel
 	}
 }
@@ -32,3 +36,105 @@ func BenchmarkDeleteCachedRecords(b *testing.B) {
 		benchRecords.DeleteRecord(*record)
 	}
 }
+
+// goroutineTTLWatcher - the expiry design ExpiryScheduler replaced, one
+// goroutine and timer per cached record
+func goroutineTTLWatcher(record Record, cachePurgeChan chan<- Record, stop <-chan struct{}) {
+	timer := time.NewTimer(time.Duration(record.TTL) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		cachePurgeChan <- record
+	case <-stop:
+	}
+}
+
+// BenchmarkExpiryGoroutines schedules b.N expiries with a watcher goroutine each
+func BenchmarkExpiryGoroutines(b *testing.B) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		go goroutineTTLWatcher(Record{ID: i, TTL: 3600}, purgeChannel, stop)
+	}
+}
+
+// BenchmarkExpiryScheduler schedules b.N expiries on a single ExpiryScheduler
+func BenchmarkExpiryScheduler(b *testing.B) {
+	expiry := newExpiryScheduler(purgeChannel)
+	go expiry.Run()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		expiry.Schedule(Record{ID: i, TTL: 3600}, time.Hour)
+	}
+}
+
+// BenchmarkExpirySchedulerRefresh moves the deadline of already scheduled expiries
+func BenchmarkExpirySchedulerRefresh(b *testing.B) {
+	expiry := newExpiryScheduler(purgeChannel)
+	for i := 0; i < 10000; i++ {
+		expiry.Schedule(Record{ID: i, TTL: 3600}, time.Hour)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		expiry.Schedule(Record{ID: i % 10000, TTL: 3600}, time.Duration(i)*time.Millisecond)
+	}
+}
+
+// BenchmarkGetRecordsByName looks names up in a cache the size of the shipped
+// recursive_max_entries
+func BenchmarkGetRecordsByName(b *testing.B) {
+	cache := RecordMap{
+		Records: make(map[int]Record),
+		names:   make(map[string][]int),
+		mu:      new(sync.Mutex),
+	}
+	for i := 0; i < 100000; i++ {
+		cache.AddRecord(Record{ID: i, Name: fmt.Sprintf("host%d", i), DomainID: 1})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.GetRecordsByName(fmt.Sprintf("host%d", i%100000), 1)
+	}
+}
+
+// BenchmarkAddRecordAtCapacity inserts into a full cache, every insert evicts
+// the least recently used name
+func BenchmarkAddRecordAtCapacity(b *testing.B) {
+	cache := RecordMap{
+		Records: make(map[int]Record),
+		names:   make(map[string][]int),
+		mu:      new(sync.Mutex),
+		limits:  newCacheLimits("bench", 100000, 0),
+	}
+	for i := 0; i < 100000; i++ {
+		cache.AddRecord(Record{ID: i, Name: fmt.Sprintf("host%d", i), DomainID: 1})
+	}
+
+	b.ResetTimer()
+	for i := 100000; i < 100000+b.N; i++ {
+		cache.AddRecord(Record{ID: i, Name: fmt.Sprintf("host%d", i), DomainID: 1})
+	}
+}
+
+// BenchmarkReverseHasDescendant checks a missing reverse name against 65k PTRs
+func BenchmarkReverseHasDescendant(b *testing.B) {
+	var reverse ReverseMap
+	reverse.Pointers = make(map[string][]Pointer)
+	reverse.targets = make(map[string][]string)
+	reverse.below = make(map[string]int)
+	reverse.mu = new(sync.Mutex)
+	for i := 0; i < 65536; i++ {
+		reverse.AddPointer(fmt.Sprintf("%d.%d.0.10.in-addr.arpa.", i%256, i/256), Pointer{Target: fmt.Sprintf("host%d.test.com.", i), TTL: 60})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reverse.HasDescendant("7.7.7.7.10.in-addr.arpa.")
+	}
+}
@@ -5,38 +5,58 @@ import (
 	"time"
 )
 
-func recordTTLWatcher(record Record, cachePurgeChan chan<- Record) {
-
-	logger("ttl_watcher").Debug("Starting ttl watcher for cached record")
-	timer := time.NewTimer(time.Duration(record.TTL) * time.Second)
-	defer timer.Stop()
-
-	logger("ttl_watcher").Debug("Started ttl watcher for cached record")
-	<-timer.C
-	logger("ttl_watcher").Debug("Removing record via cache purge channel")
-	cachePurgeChan <- record
-	logger("ttl_watcher").Debug("Removed record via cache purge channel")
-	return
-
-}
-
-func addRecordToCache(record Record, recSlice RecordMap, cacheChan chan<- Record, cachePurgeChan chan<- Record) error {
+func addRecordToCache(record Record, recSlice RecordMap, cacheChan chan<- Record) error {
 	// if record already exists in cache, do nothing
 	if recSlice.Contains(record) {
 		return nil
 	}
 
+	if !applyCachePolicy(&record) {
+		return nil
+	}
+
 	logger("cache").Debug("Adding record to cache channel")
 	record.DOB = time.Now()
 	//recSlice[record.ID] = record
 	cacheChan <- record
 	logger("cache").Debug("Added record to cache channel")
 
-	go recordTTLWatcher(record, cachePurgeChan)
+	// expired records are kept to be served stale while the backend is down
+	recSlice.expiry.Schedule(record, time.Duration(record.cacheTTL())*time.Second+staleWindow)
 
 	return nil
 }
 
+// replaceCachedSet caches set in place of the set cached under name in the
+// domain, synchronously so that queries never find the name missing in
+// between. Sets loaded from MySQL or upstream go through here
+func replaceCachedSet(domainID int64, name string, set []Record, recSlice RecordMap) {
+	var cached []Record
+	for _, record := range set {
+		if !applyCachePolicy(&record) {
+			continue
+		}
+		if record.DOB.IsZero() {
+			record.DOB = time.Now()
+		}
+		cached = append(cached, record)
+	}
+
+	// cancel before scheduling, the new set may reuse ids of the old one
+	recSlice.cancelExpiry(recSlice.ReplaceSet(domainID, name, cached))
+	for _, record := range cached {
+		recSlice.expiry.Schedule(record, time.Duration(record.cacheTTL())*time.Second+staleWindow)
+	}
+}
+
+// applyCachePolicy applies the cache policy of an authoritative record about
+// to be cached, false when the record must stay out of the cache
+func applyCachePolicy(record *Record) bool {
+	policy := recordPolicy(*record)
+	record.CacheTTL = policy.CacheTTL
+	return !policy.NoCache
+}
+
 func addDomainToCache(domain Domain, recSlice DomainMap, cacheChan chan<- Domain) error {
 	if recSlice.Contains(domain) {
 		return nil
@@ -59,7 +79,12 @@ func watchCache(cacheChan <-chan Record, cachePurgeChan <-chan Record, recSlice
 		case msg := <-cachePurgeChan:
 			logger("cache").Debug(fmt.Sprint("Purge record signal received: ", msg))
 			logger("cache").Debug("Removing record from slice")
-			recSlice.DeleteRecord(msg)
+			// expiries carry the DOB the record was cached with, redis purges don't
+			if msg.DOB.IsZero() {
+				recSlice.DeleteRecordSet(msg)
+			} else if !recSlice.ExpireRecordSet(msg) {
+				logger("cache").Debug("Record was reloaded since its expiry was scheduled, keeping it")
+			}
 			logger("cache").Debug("Removed record from slice")
 		}
 	}
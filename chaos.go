@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"gopkg.in/ini.v1"
+)
+
+// chaosIdentity - TXT answers for CH class identity queries, names left
+// empty are refused
+var chaosIdentity = make(map[string]string)
+
+// chaosRefuse - refuse every CH class query
+var chaosRefuse = false
+
+// loadChaosConfig reads the chaos_* keys of the [dns] section. version.bind
+// and version.server share chaos_version, hostname.bind and id.server default
+// to the machine hostname
+func loadChaosConfig(section *ini.Section) {
+	hostname, _ := os.Hostname()
+
+	chaosRefuse, _ = section.Key("chaos_refuse").Bool()
+	version := chaosConfigValue(section, "chaos_version", "uberdns")
+	chaosIdentity = map[string]string{
+		"version.bind.":   version,
+		"version.server.": version,
+		"hostname.bind.":  chaosConfigValue(section, "chaos_hostname", hostname),
+		"id.server.":      chaosConfigValue(section, "chaos_id", hostname),
+	}
+}
+
+// chaosConfigValue returns the key's value, an explicitly empty key stays
+// empty so the name can be hidden
+func chaosConfigValue(section *ini.Section, key string, def string) string {
+	if section.HasKey(key) {
+		return section.Key(key).String()
+	}
+	return def
+}
+
+// chaosAnswer fills msg with the answer for a CH class query
+func chaosAnswer(msg *dns.Msg, fqdn string, qtype uint16) {
+	value := chaosIdentity[strings.ToLower(dns.Fqdn(fqdn))]
+	if chaosRefuse || value == "" {
+		msg.Rcode = dns.RcodeRefused
+		return
+	}
+
+	if qtype == dns.TypeTXT || qtype == dns.TypeANY {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+			Txt: txtStrings(value),
+		})
+	}
+}
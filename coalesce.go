@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// errLookupAborted - seen by the requests waiting on a lookup that panicked
+var errLookupAborted = errors.New("shared lookup aborted")
+
+// inflightLookup - a lookup shared by every request that missed the cache
+// for the same key while it runs
+type inflightLookup struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// lookupGroup - coalesces concurrent identical cache misses against one
+// backend, so a popular name expiring costs a single MySQL or upstream query
+type lookupGroup struct {
+	backend string // backend label for metrics
+	calls   map[string]*inflightLookup
+	mu      *sync.Mutex
+}
+
+var mysqlLookups = newLookupGroup("mysql")
+var upstreamLookups = newLookupGroup("upstream")
+
+func newLookupGroup(backend string) *lookupGroup {
+	return &lookupGroup{
+		backend: backend,
+		calls:   make(map[string]*inflightLookup),
+		mu:      new(sync.Mutex),
+	}
+}
+
+// Do runs lookup unless one is already running for key, in which case it
+// waits for that one and returns its result instead
+func (g *lookupGroup) Do(key string, lookup func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		coalescedLookupCounter.WithLabelValues(g.backend).Inc()
+		<-call.done
+		return call.result, call.err
+	}
+	call := &inflightLookup{done: make(chan struct{}), err: errLookupAborted}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.result, call.err = lookup()
+	return call.result, call.err
+}
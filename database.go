@@ -5,8 +5,13 @@ import (
 	"fmt"
 )
 
+// dbTimeout bounds connecting to and reading from MySQL, so lookups fail fast
+// and stale records are served quickly while the database is unreachable
+const dbTimeout = "2s"
+
 func dbConnect(username string, password string, host string, port int, database string) error {
-	conn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", username, password, host, port, database)
+	conn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?timeout=%s&readTimeout=%s",
+		username, password, host, port, database, dbTimeout, dbTimeout)
 	logger("db").Info("Connecting to " + host)
 	dbc, err := sql.Open("mysql", conn)
 
@@ -22,6 +27,6 @@ func dbConnect(username string, password string, host string, port int, database
 
 	logger("db").Debug("DB Ping successful")
 
-	dbConn = *dbc
+	dbConn = dbc
 	return nil
 }
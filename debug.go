@@ -16,12 +16,24 @@ func debugDomainHandler(w http.ResponseWriter, r *http.Request) {
 	type Debug struct {
 		RecursiveCount   int
 		RecursiveDomains map[int]Domain
+		DomainCount      int
+		Domains          map[int]Domain
 	}
-
+	// lookups read the maps concurrently, only read them through locked copies
 	var data = Debug{
-		RecursiveCount:   len(recursiveDomains.Domains),
-		RecursiveDomains: recursiveDomains.Domains,
+		RecursiveDomains: make(map[int]Domain),
+		Domains:          make(map[int]Domain),
+	}
+	for i, name := range recursiveDomains() {
+		data.RecursiveDomains[i] = Domain{ID: int64(i), Name: name}
 	}
+	data.RecursiveCount = len(data.RecursiveDomains)
+	domains.mu.Lock()
+	for id, domain := range domains.Domains {
+		data.Domains[id] = domain
+	}
+	domains.mu.Unlock()
+	data.DomainCount = len(data.Domains)
 
 	jd, _ := json.Marshal(data)
 	w.Write([]byte(jd))
@@ -32,10 +44,14 @@ func debugRecordHandler(w http.ResponseWriter, r *http.Request) {
 		RecursiveCount   int
 		RecursiveRecords map[int]Record
 	}
+	// cache hits write to the map, only read it through a locked copy
 	var data = Debug{
-		RecursiveCount:   len(recursiveRecords.Records),
-		RecursiveRecords: recursiveRecords.Records,
+		RecursiveRecords: make(map[int]Record),
+	}
+	for _, record := range recursiveRecords.Snapshot() {
+		data.RecursiveRecords[record.ID] = record
 	}
+	data.RecursiveCount = len(data.RecursiveRecords)
 
 	jd, _ := json.Marshal(data)
 	w.Write([]byte(jd))
@@ -3,9 +3,10 @@ package main
 import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -45,6 +46,27 @@ func (d *DomainMap) GetDomainByName(name string) Domain {
 	return Domain{}
 }
 
+// GetDomainBySuffix returns the domain fqdn belongs to. The longest matching
+// name wins, so delegated subzones (dev.example.com) and multi-label public
+// suffixes (example.co.uk) match their own dns_domain row
+func (d *DomainMap) GetDomainBySuffix(fqdn string) Domain {
+	var domain Domain
+	name := strings.ToLower(strings.TrimRight(fqdn, "."))
+	d.mu.Lock()
+	for i := range d.Domains {
+		zone := strings.ToLower(d.Domains[i].Name)
+		if name != zone && !strings.HasSuffix(name, "."+zone) {
+			continue
+		}
+		if len(zone) > len(domain.Name) {
+			domain = d.Domains[i]
+		}
+	}
+	d.mu.Unlock()
+
+	return domain
+}
+
 func (d *DomainMap) AddDomain(domain Domain) {
 	d.mu.Lock()
 	d.Domains[int(domain.ID)] = domain
@@ -84,6 +106,49 @@ func (d *DomainMap) Count() int {
 	return i
 }
 
+// isAddress reports whether the record carries A/AAAA data, records without
+// a type predate record_type and are always addresses
+func (r Record) isAddress() bool {
+	return r.Type == recordTypeA || r.Type == ""
+}
+
+// cacheTTL returns how long the record stays cached, its TTL unless a cache
+// policy forces another
+func (r Record) cacheTTL() int64 {
+	if r.CacheTTL > 0 {
+		return r.CacheTTL
+	}
+	return r.TTL
+}
+
+// remainingTTL returns the TTL left from the record's own TTL since it was
+// cached, so downstream caches don't extend its lifetime. A cache policy only
+// changes how long the record stays cached, not the TTL it is served with.
+// A record that is still cached is never handed out with a TTL of 0, records
+// past their TTL get staleTTL, never more than the TTL itself while a policy
+// still holds them fresh
+func (r Record) remainingTTL() uint32 {
+	if r.TTL <= 0 || r.DOB.IsZero() {
+		return uint32(r.TTL)
+	}
+
+	remaining := r.TTL - int64(time.Since(r.DOB)/time.Second)
+	if remaining < 1 {
+		if !r.expired() && r.TTL < staleTTL {
+			return uint32(r.TTL)
+		}
+		return staleTTL
+	}
+	return uint32(remaining)
+}
+
+// sameData reports whether both records hold the same answer, ignoring ids
+// and cache bookkeeping
+func (r Record) sameData(o Record) bool {
+	r.ID, r.TTL, r.CacheTTL, r.Created, r.DOB, r.Hits = o.ID, o.TTL, o.CacheTTL, o.Created, o.DOB, o.Hits
+	return r == o
+}
+
 func (r *RecordMap) GetRecords() map[int]Record {
 	var records = make(map[int]Record)
 	r.mu.Lock()
@@ -102,29 +167,42 @@ func (r *RecordMap) GetRecordByID(id int) Record {
 	return record
 }
 
-func (r *RecordMap) GetRecordByName(name string, domainId int64) Record {
-	var record Record
-	r.mu.Lock()
-	for i := range r.Records {
-		if r.Records[i].DomainID != domainId {
-			continue
-		}
+// ownerKey returns the key of the set a record belongs to in RecordMap.names,
+// names are matched case-insensitively
+func ownerKey(domainID int64, name string) string {
+	return strconv.FormatInt(domainID, 10) + "/" + strings.ToLower(name)
+}
 
-		if r.Records[i].Name == name {
-			record = r.Records[i]
+// GetRecordsByName returns every cached record under name in the domain
+func (r *RecordMap) GetRecordsByName(name string, domainId int64) []Record {
+	var set []Record
+	r.mu.Lock()
+	for _, id := range r.names[ownerKey(domainId, name)] {
+		record := r.Records[id]
+		record.Hits++
+		r.Records[id] = record
+		set = append(set, record)
+		if r.limits != nil {
+			r.limits.touch(id)
 		}
 	}
 	r.mu.Unlock()
 
-	return record
+	// keep the set in database order, RRset ordering is applied when answering
+	sort.Slice(set, func(i, j int) bool {
+		return set[i].ID < set[j].ID
+	})
+
+	return set
 }
 
 func (r *RecordMap) Contains(record Record) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	for i := range r.Records {
-		if r.Records[i].Name == record.Name {
+	for _, id := range r.names[ownerKey(record.DomainID, record.Name)] {
+		// either the same row or an identical answer cached under another id
+		if id == record.ID || r.Records[id].sameData(record) {
 			return true
 		}
 	}
@@ -133,15 +211,159 @@ func (r *RecordMap) Contains(record Record) bool {
 }
 
 func (r *RecordMap) AddRecord(record Record) {
+	var evicted []int
 	r.mu.Lock()
-	r.Records[record.ID] = record
+	r.insert(record)
+	if r.limits != nil {
+		evicted = r.evict(record)
+	}
 	r.mu.Unlock()
+
+	r.cancelExpiry(evicted)
+}
+
+// ReplaceSet swaps the set cached under name in the domain for set in one
+// step, so queries never find the name missing or half replaced. Returns the
+// ids that left the cache, set may reuse some of them
+func (r *RecordMap) ReplaceSet(domainID int64, name string, set []Record) []int {
+	r.mu.Lock()
+	removed := r.removeSet(ownerKey(domainID, name))
+	for i := range set {
+		r.insert(set[i])
+	}
+	if r.limits != nil && len(set) > 0 {
+		removed = append(removed, r.evict(set[0])...)
+	}
+	r.mu.Unlock()
+
+	return removed
+}
+
+// Owners returns the lowercased names records are cached under
+func (r *RecordMap) Owners() []string {
+	r.mu.Lock()
+	owners := make([]string, 0, len(r.names))
+	for key := range r.names {
+		owners = append(owners, key[strings.Index(key, "/")+1:])
+	}
+	r.mu.Unlock()
+
+	return owners
+}
+
+// insert adds a record to the map, the owner index and the LRU, r.mu must be held
+func (r *RecordMap) insert(record Record) {
+	r.remove(record.ID)
+	r.Records[record.ID] = record
+	key := ownerKey(record.DomainID, record.Name)
+	r.names[key] = append(r.names[key], record.ID)
+	if r.limits != nil {
+		r.limits.add(record)
+	}
 }
 
 func (r *RecordMap) DeleteRecord(record Record) {
 	r.mu.Lock()
-	delete(r.Records, record.ID)
+	r.remove(record.ID)
+	r.mu.Unlock()
+}
+
+// DeleteRecordSet removes the record along with every other record cached
+// under the same name, so a name is never served from a partial set
+func (r *RecordMap) DeleteRecordSet(record Record) {
+	var purged []int
+	r.mu.Lock()
+	if r.remove(record.ID) {
+		purged = append(purged, record.ID)
+	}
+	purged = append(purged, r.removeSet(ownerKey(record.DomainID, record.Name))...)
+	r.mu.Unlock()
+
+	r.cancelExpiry(purged)
+}
+
+// ExpireRecordSet removes the set of a record whose expiry ran out, unless the
+// set was reloaded since it was scheduled: authoritative records keep their
+// MySQL id, so a reloaded set is told apart by the DOB of the record
+func (r *RecordMap) ExpireRecordSet(record Record) bool {
+	r.mu.Lock()
+	cached, ok := r.Records[record.ID]
+	if !ok || !cached.DOB.Equal(record.DOB) {
+		r.mu.Unlock()
+		return false
+	}
+	purged := r.removeSet(ownerKey(cached.DomainID, cached.Name))
+	r.mu.Unlock()
+
+	r.cancelExpiry(purged)
+	return true
+}
+
+// Purge removes every cached record matching, cancelling their pending
+// expiries, and returns how many were removed
+func (r *RecordMap) Purge(match func(Record) bool) int {
+	var purged []int
+	r.mu.Lock()
+	for i := range r.Records {
+		if match(r.Records[i]) {
+			purged = append(purged, i)
+		}
+	}
+	for _, id := range purged {
+		r.remove(id)
+	}
 	r.mu.Unlock()
+
+	r.cancelExpiry(purged)
+	return len(purged)
+}
+
+// remove drops a record from the map, the owner index and the LRU, and
+// reports whether it was cached. r.mu must be held
+func (r *RecordMap) remove(id int) bool {
+	record, ok := r.Records[id]
+	if !ok {
+		return false
+	}
+
+	key := ownerKey(record.DomainID, record.Name)
+	var ids []int
+	for _, i := range r.names[key] {
+		if i != id {
+			ids = append(ids, i)
+		}
+	}
+	if len(ids) == 0 {
+		delete(r.names, key)
+	} else {
+		r.names[key] = ids
+	}
+
+	delete(r.Records, id)
+	if r.limits != nil {
+		r.limits.remove(id)
+	}
+	return true
+}
+
+// removeSet drops every record of the set under key and returns their ids,
+// r.mu must be held
+func (r *RecordMap) removeSet(key string) []int {
+	ids := append([]int(nil), r.names[key]...)
+	for _, id := range ids {
+		r.remove(id)
+	}
+	return ids
+}
+
+// cancelExpiry drops the pending expiries of records removed from the cache
+func (r *RecordMap) cancelExpiry(ids []int) {
+	if r.expiry == nil {
+		return
+	}
+	for _, id := range ids {
+		r.expiry.Cancel(id)
+	}
 }
 
 func (r *RecordMap) Count() int {
@@ -152,7 +374,59 @@ func (r *RecordMap) Count() int {
 	return i
 }
 
-type handler struct{}
+// Outcomes counted by responseCounter
+const (
+	outcomeAnswer          = "answer"
+	outcomeNXDomain        = "nxdomain"
+	outcomeNoData          = "nodata"
+	outcomeBackendFailure  = "backend_failure"
+	outcomeUpstreamFailure = "upstream_failure"
+	outcomeCNAMELoop       = "cname_loop"
+)
+
+// responseOutcome classifies an answer for responseCounter, err is the error
+// that turned it into a SERVFAIL if any
+func responseOutcome(msg *dns.Msg, err error) string {
+	switch {
+	case err == errUpstreamFailed:
+		return outcomeUpstreamFailure
+	case err == errCNAMELoop:
+		return outcomeCNAMELoop
+	case err != nil:
+		return outcomeBackendFailure
+	case msg.Rcode == dns.RcodeNameError:
+		return outcomeNXDomain
+	case msg.Rcode == dns.RcodeServerFailure:
+		// only passed through from an upstream server
+		return outcomeUpstreamFailure
+	case msg.Rcode != dns.RcodeSuccess:
+		return strings.ToLower(dns.RcodeToString[msg.Rcode])
+	case len(msg.Answer) == 0:
+		return outcomeNoData
+	}
+	return outcomeAnswer
+}
+
+// recursiveRecordID - last id handed out to a record of the recursive cache
+var recursiveRecordID int64
+
+// nextRecursiveID returns a unique id for a record of the recursive cache,
+// these don't come from the database but still key the RecordMap
+func nextRecursiveID() int {
+	return int(atomic.AddInt64(&recursiveRecordID, 1))
+}
+
+// Recursive ANY query policies (RFC 8482), set per listener with
+// any_policy_udp/any_policy_tcp in the [dns] section of config.ini
+const (
+	anyPolicyRefuse  = "refuse"  // answer REFUSED
+	anyPolicyMinimal = "minimal" // answer with a single RRset of the upstream answer
+	anyPolicyForward = "forward" // pass the upstream answer through untouched
+)
+
+type handler struct {
+	anyPolicy string
+}
 
 func domainChannelHandler(channel <-chan Domain, domSlice DomainMap) {
 	for {
@@ -165,16 +439,67 @@ func domainChannelHandler(channel <-chan Domain, domSlice DomainMap) {
 	}
 }
 
-func startListening(protocol string, port int) {
+func startListening(protocol string, port int, anyPolicy string) {
 	srv := &dns.Server{Addr: ":" + strconv.Itoa(port), Net: protocol}
-	srv.Handler = &handler{}
+	srv.Handler = &handler{anyPolicy: anyPolicy}
 	if err := srv.ListenAndServe(); err != nil {
 		logger("dns").Fatalf("Failed to set %s listener %s\n", protocol, err.Error())
 	}
 }
 
+// supportedClasses - query classes answered by the handler
+var supportedClasses = map[uint16]bool{
+	dns.ClassINET:  true,
+	dns.ClassCHAOS: true,
+}
+
+// validateQuery returns the rcode a malformed or unsupported query is refused
+// with, or RcodeSuccess when it can be answered
+func validateQuery(r *dns.Msg) int {
+	switch {
+	case r.Opcode != dns.OpcodeQuery:
+		return dns.RcodeNotImplemented
+	case len(r.Question) != 1:
+		return dns.RcodeFormatError
+	case !supportedClasses[r.Question[0].Qclass]:
+		return dns.RcodeNotImplemented
+	}
+	return dns.RcodeSuccess
+}
+
+// writeMsg writes the response, a client going away must not take the
+// server down with it so failures are only logged and counted
+func writeMsg(w dns.ResponseWriter, msg *dns.Msg) {
+	if err := w.WriteMsg(msg); err != nil {
+		logger("dns").Warning(fmt.Sprintf("Failed to write response to %s: %s", w.RemoteAddr().String(), err.Error()))
+		writeErrorCounter.WithLabelValues(w.LocalAddr().Network()).Inc()
+	}
+}
+
+// replyRcode answers r with an empty response carrying rcode
+func replyRcode(w dns.ResponseWriter, r *dns.Msg, rcode int, queryType string) {
+	msg := new(dns.Msg)
+	msg.SetRcode(r, rcode)
+	responseCounter.WithLabelValues(queryType, strings.ToLower(dns.RcodeToString[rcode])).Inc()
+	writeMsg(w, msg)
+}
+
 func (fuck *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	timeStart := time.Now()
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			logger("dns").Error(fmt.Sprintf("Recovered from panic while answering %s: %v", w.RemoteAddr().String(), rec))
+			replyRcode(w, r, dns.RcodeServerFailure, "panic")
+		}
+	}()
+
+	if rcode := validateQuery(r); rcode != dns.RcodeSuccess {
+		logger("dns").Debug(fmt.Sprintf("Rejecting query from %s: %s", w.RemoteAddr().String(), dns.RcodeToString[rcode]))
+		replyRcode(w, r, rcode, "invalid")
+		return
+	}
+
 	msg := dns.Msg{}
 	msg.MsgHdr = dns.MsgHdr{
 		Id:                 r.Id,
@@ -189,161 +514,41 @@ func (fuck *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	domain := msg.Question[0].Name
 	msg.Authoritative = true
 
-	cleanDomain := strings.TrimRight(domain, ".")
-	domainSplit := strings.Split(cleanDomain, ".")
-	// Capture domain name plus TLD
-	var subdomain string
-	var topLevelDomain string
-	if strings.Count(cleanDomain, ".") > 1 {
-		subdomain = domainSplit[0]
-		domainSplit := strings.Split(cleanDomain, ".")
-		var s = []string{domainSplit[len(domainSplit)-2], domainSplit[len(domainSplit)-1]}
-		topLevelDomain = strings.Join(s, ".")
-	} else {
-		topLevelDomain = cleanDomain
-	}
-
 	logger("dns").Debug(fmt.Sprintf("Query received: %s", msg.Question[0].Name))
 
-	// Currently we only cache A records, if the question is of a non-A type - default to recursiveResolve lookup
-	if r.Question[0].Qtype != dns.TypeA {
-		rr := recurseResolve(msg.Question[0].Name, r.Question[0].Qtype)
-		for i := range rr {
-			msg.Answer = append(msg.Answer, rr[i])
-		}
-	}
-
-	var realDomain Domain
-	copyDomains := domains.GetDomains()
-	for _, d := range copyDomains {
-		if topLevelDomain == d.Name {
-			realDomain = d
-		}
-	}
-
-	if (Domain{}) == realDomain {
-		logger("recurse_dns").Debug(fmt.Sprintf("Starting recursive lookup: %s", msg.Question[0].Name))
-
-		var recurseDomain Domain
-		realDomain.Name = topLevelDomain
-		if recursiveDomains.Contains(realDomain) {
-			recurseDomain = recursiveDomains.GetDomainByName(topLevelDomain)
-		}
-
-		if (Domain{}) == recurseDomain {
-			logger("recurse_dns").Debug("Recurse domain not found, performing lookup")
-			domObj := Domain{
-				ID:   int64(recursiveDomains.Count()),
-				Name: topLevelDomain,
-			}
-			rr := recurseResolve(domain, r.Question[0].Qtype)
-			for i := range rr {
-				logger("recurse_dns").Debug("Adding recurive domain to local cache")
-				addDomainToCache(domObj, recursiveDomains, recursiveDomainChannel)
-				msg.Answer = append(msg.Answer, rr[i])
-				// if its an A record, we should cache it!
-				switch rr[i].Header().Rrtype {
-				case dns.TypeA:
-					rrr := Record{
-						Name:     subdomain,
-						IP:       rr[i].(*dns.A).A.String(),
-						TTL:      int64(rr[i].(*dns.A).Hdr.Ttl),
-						Created:  time.Now(),
-						DOB:      time.Now(),
-						DomainID: domObj.ID,
-					}
-
-					rrr.ID = recursiveRecords.Count()
-
-					recursiveRecords.mu.Lock()
-					copyr := recursiveRecords
-					recursiveRecords.mu.Unlock()
-
-					go addRecordToCache(rrr, copyr, recursiveCacheChannel, recursiveCachePurgeChannel)
-				}
-			}
-			w.WriteMsg(&msg)
+	subdomain, realDomain := findZone(domain)
+
+	var queryType string
+	var err error
+	if r.Question[0].Qclass == dns.ClassCHAOS {
+		queryType = "chaos"
+		chaosAnswer(&msg, domain, r.Question[0].Qtype)
+	} else if reverseZone := getReverseZone(domain); reverseZone != "" {
+		queryType = "reverse"
+		reverseAnswer(&msg, domain, r.Question[0].Qtype, reverseZone)
+	} else if (Domain{}) == realDomain {
+		queryType = "recurse"
+		if r.Question[0].Qtype == dns.TypeANY && fuck.anyPolicy == anyPolicyRefuse {
+			msg.Rcode = dns.RcodeRefused
 		} else {
-			logger("recurse_dns").Debug("Recurse domain found in cache")
-			var device = recursiveRecords.GetRecordByName(subdomain, recurseDomain.ID)
-
-			if (Record{}) == device {
-				rr := recurseResolve(domain, r.Question[0].Qtype)
-
-				logger("recurse_dns").Debug("Recurse record not found in cache, performing lookup")
-
-				for i := range rr {
-					msg.Answer = append(msg.Answer, rr[i])
-					switch rr[i].Header().Rrtype {
-					case dns.TypeA:
-						rrr := Record{
-							ID:       recursiveRecords.Count(),
-							Name:     subdomain,
-							TTL:      int64(rr[i].(*dns.A).Hdr.Ttl),
-							IP:       rr[i].(*dns.A).A.String(),
-							Created:  time.Now(),
-							DOB:      time.Now(),
-							DomainID: recurseDomain.ID,
-						}
-						go addRecordToCache(rrr, recursiveRecords, recursiveCacheChannel, recursiveCachePurgeChannel)
-					}
-				}
-				w.WriteMsg(&msg)
-				recordQueryCounter.WithLabelValues("recurse", dns.TypeToString[r.Question[0].Qtype]).Inc()
-
-			} else {
-				logger("recurse_dns").Debug("Returning cached recursive record")
-
-				msg.Answer = append(msg.Answer, &dns.A{
-					Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(device.TTL)},
-					A:   net.ParseIP(device.IP),
-				})
+			err = recursiveAnswer(&msg, domain, r.Question[0].Qtype, r.Question[0].Qclass)
+			if r.Question[0].Qtype == dns.TypeANY && fuck.anyPolicy == anyPolicyMinimal {
+				msg.Answer = minimalRRset(msg.Answer)
 			}
-			err := w.WriteMsg(&msg)
-			if err != nil {
-				log.Fatal(err)
-			}
-			recordQueryCounter.WithLabelValues("recurse", dns.TypeToString[r.Question[0].Qtype]).Inc()
 		}
 	} else {
-
 		// Domain matches, we should continue to search
-		var device Record
-		copyRecords := records.GetRecords()
-		for i, j := range copyRecords {
-			if j.DomainID != realDomain.ID {
-				continue
-			}
-			if copyRecords[i].Name == subdomain {
-				device = copyRecords[i]
-			}
-		}
-
-		if (Record{}) == device {
-			//No existing records found in local cache, perform sql lookup
-			// if the sql lookup fails then we give up
-			device, _ = getRecordFromHost(subdomain, realDomain.ID)
-
-			// Ensure non-empty device
-			if (Record{}) != device {
-				logger("dns").Debug(fmt.Sprintf("Adding record %s.%s to cache", subdomain, realDomain.Name))
-				device.DOB = time.Now()
-				go addRecordToCache(device, records, recordCacheChannel, recordCachePurgeChannel)
-			}
-
-		}
+		queryType = "uberdns"
+		err = authoritativeAnswer(&msg, domain, r.Question[0].Qtype, subdomain, realDomain)
+	}
 
-		switch r.Question[0].Qtype {
-		case dns.TypeA:
-			msg.Answer = append(msg.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(device.TTL)},
-				A:   net.ParseIP(device.IP),
-			})
-		}
-		recordQueryCounter.WithLabelValues("uberdns", dns.TypeToString[r.Question[0].Qtype]).Inc()
+	if err != nil {
+		logger("dns").Error(fmt.Sprintf("Failed to answer %s: %s", domain, err.Error()))
 	}
-	// Cached dns record
-	w.WriteMsg(&msg)
+	recordQueryCounter.WithLabelValues(queryType, dns.TypeToString[r.Question[0].Qtype]).Inc()
+	responseCounter.WithLabelValues(queryType, responseOutcome(&msg, err)).Inc()
+
+	writeMsg(w, &msg)
 
 	timeStop := time.Now()
 	log.WithFields(log.Fields{
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiryItem - a cached record waiting for its TTL to run out
+type expiryItem struct {
+	record Record
+	at     time.Time
+	index  int
+}
+
+// expiryQueue - min-heap of expiryItems ordered by deadline
+type expiryQueue []*expiryItem
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// ExpiryScheduler - expires the records of a cache from a single goroutine and
+// timer, records are handed to the cache purge channel once their deadline passes
+type ExpiryScheduler struct {
+	items map[int]*expiryItem
+	queue expiryQueue
+	mu    *sync.Mutex
+	wake  chan struct{}
+	purge chan<- Record
+}
+
+func newExpiryScheduler(purge chan<- Record) *ExpiryScheduler {
+	return &ExpiryScheduler{
+		items: make(map[int]*expiryItem),
+		mu:    new(sync.Mutex),
+		wake:  make(chan struct{}, 1),
+		purge: purge,
+	}
+}
+
+// Schedule expires the record ttl from now, a record that is already
+// scheduled has its deadline moved instead (refresh)
+func (e *ExpiryScheduler) Schedule(record Record, ttl time.Duration) {
+	at := time.Now().Add(ttl)
+
+	e.mu.Lock()
+	if item, ok := e.items[record.ID]; ok {
+		item.record = record
+		item.at = at
+		heap.Fix(&e.queue, item.index)
+	} else {
+		item = &expiryItem{record: record, at: at}
+		heap.Push(&e.queue, item)
+		e.items[record.ID] = item
+	}
+	e.mu.Unlock()
+
+	e.notify()
+}
+
+// Cancel drops the record's pending expiry
+func (e *ExpiryScheduler) Cancel(id int) {
+	e.mu.Lock()
+	if item, ok := e.items[id]; ok {
+		heap.Remove(&e.queue, item.index)
+		delete(e.items, id)
+	}
+	e.mu.Unlock()
+}
+
+func (e *ExpiryScheduler) Count() int {
+	var i int
+	e.mu.Lock()
+	i = len(e.items)
+	e.mu.Unlock()
+	return i
+}
+
+// notify wakes Run up to recompute its next deadline
+func (e *ExpiryScheduler) notify() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run purges records as their deadlines pass, it never returns
+func (e *ExpiryScheduler) Run() {
+	for {
+		var expired []Record
+		now := time.Now()
+		wait := time.Hour
+
+		e.mu.Lock()
+		for len(e.queue) > 0 && !e.queue[0].at.After(now) {
+			item := heap.Pop(&e.queue).(*expiryItem)
+			delete(e.items, item.record.ID)
+			expired = append(expired, item.record)
+		}
+		if len(e.queue) > 0 {
+			wait = e.queue[0].at.Sub(now)
+		}
+		e.mu.Unlock()
+
+		// the purge channel is read by watchCache, which may itself be waiting
+		// on e.mu to cancel an expiry - only send with the lock released
+		for _, record := range expired {
+			logger("ttl_watcher").Debug("Removing record via cache purge channel")
+			e.purge <- record
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-e.wake:
+		}
+		timer.Stop()
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"database/sql"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"strings"
 )
 
 func populateData(done chan<- bool) {
 	log.Info("[DATA] Populating data.")
-	query := "SELECT id, name FROM dns_domain"
+	query := "SELECT id, name, mname, rname, serial, refresh, retry, expire, minimum, ttl, nameservers FROM dns_domain"
 	log.Debug("Query: " + query)
 	dq, err := dbConn.Prepare(query)
 
@@ -27,21 +28,145 @@ func populateData(done chan<- bool) {
 
 	for rows.Next() {
 		var (
-			id   int64
-			name string
+			id                                           int64
+			name                                         string
+			mname, rname, nameservers                    sql.NullString
+			serial, refresh, retry, expire, minimum, ttl sql.NullInt64
 		)
 
-		if err := rows.Scan(&id, &name); err != nil {
+		if err := rows.Scan(&id, &name, &mname, &rname, &serial, &refresh, &retry, &expire, &minimum, &ttl, &nameservers); err != nil {
 			log.Error(err)
 		}
 		log.Debug("Domain found: " + name)
-		domains.Domains[int(id)] = Domain{ID: id, Name: name}
+
+		domain := Domain{
+			ID:          id,
+			Name:        name,
+			MName:       mname.String,
+			RName:       rname.String,
+			Serial:      uint32(serial.Int64),
+			Refresh:     uint32(refresh.Int64),
+			Retry:       uint32(retry.Int64),
+			Expire:      uint32(expire.Int64),
+			Minimum:     uint32(minimum.Int64),
+			TTL:         ttl.Int64,
+			Nameservers: nameservers.String,
+		}
+		domains.Domains[int(id)] = domain.withSOADefaults()
 	}
 	log.Info("[DATA] Data populated.")
 
 	done <- true
 }
 
+// getZoneNames returns the distinct owner names of the records in a domain
+func getZoneNames(domainID int64) ([]string, error) {
+	var names []string
+
+	query := "SELECT DISTINCT name FROM dns_record WHERE domain_id = ?"
+	dq, err := dbConn.Prepare(query)
+	log.Debug("Query: " + query)
+
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	defer dq.Close()
+
+	rows, err := dq.Query(domainID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// hasRecordsBelow reports whether any record exists below name in the domain,
+// which makes name an empty non-terminal when it has no records of its own
+func hasRecordsBelow(name string, domainID int64) (bool, error) {
+	var found int
+
+	// escape LIKE wildcards, record names such as _sip._tcp contain underscores
+	pattern := "%." + strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(name)
+	if name == "" {
+		pattern = "%"
+	}
+
+	query := "SELECT 1 FROM dns_record WHERE domain_id = ? AND name LIKE ? LIMIT 1"
+	dq, err := dbConn.Prepare(query)
+	log.Debug("Query: " + query)
+
+	if err != nil {
+		log.Error(err)
+		return false, err
+	}
+
+	defer dq.Close()
+
+	err = dq.QueryRow(domainID, pattern).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		log.Error(err)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// populateReverseData builds the reverse index from every address record in
+// the database
+func populateReverseData() error {
+	log.Info("[DATA] Populating reverse data.")
+	query := "SELECT id, name, ip_address, ipv6_address, ttl, domain_id FROM dns_record WHERE record_type = 'A'"
+	log.Debug("Query: " + query)
+	dq, err := dbConn.Prepare(query)
+
+	if err != nil {
+		return err
+	}
+
+	defer dq.Close()
+
+	rows, err := dq.Query()
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var record Record
+		var ip, ipv6 sql.NullString
+
+		if err := rows.Scan(&record.ID, &record.Name, &ip, &ipv6, &record.TTL, &record.DomainID); err != nil {
+			log.Error(err)
+			continue
+		}
+		record.Type = recordTypeA
+		record.IP = ip.String
+		record.IPv6 = ipv6.String
+
+		indexRecord(record, domains.GetDomainByID(int(record.DomainID)))
+	}
+	log.Info(fmt.Sprintf("[DATA] Reverse data populated, %d names.", reverseRecords.Count()))
+
+	return rows.Err()
+}
+
 func getDomain(domainName string) (Domain, error) {
 	var domain Domain
 
@@ -65,28 +190,63 @@ func getDomain(domainName string) (Domain, error) {
 	return domain, nil
 }
 
-func getRecordFromHost(host string, domainID int64) (Record, error) {
-	var record Record
+// getRecordsFromHost returns every record stored under host in the domain,
+// a name may carry several records (e.g. an address plus MX and TXT records)
+func getRecordsFromHost(host string, domainID int64) ([]Record, error) {
+	var set []Record
+
+	// apex records are stored as @, rows predating that use an empty name
+	legacyName := host
+	if host == apexName {
+		legacyName = ""
+	}
 
-	query := "SELECT id, name, ip_address, ttl, domain_id FROM dns_record WHERE name = ? AND domain_id = ?"
+	query := "SELECT id, name, record_type, ip_address, ipv6_address, target, priority, weight, port, content, ttl, domain_id FROM dns_record WHERE name IN (?, ?) AND domain_id = ?"
 	dq, err := dbConn.Prepare(query)
 	log.Debug("Query: " + query)
 
 	if err != nil {
 		log.Error(err)
+		return nil, err
 	}
 
 	defer dq.Close()
 
-	err = dq.QueryRow(host, domainID).Scan(&record.ID, &record.Name, &record.IP, &record.TTL, &record.DomainID)
+	rows, err := dq.Query(host, legacyName, domainID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Warning("Lookup failed but domain was valid.")
-		} else {
+		log.Error(err)
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var record Record
+		var ip, ipv6, target, content sql.NullString
+		var priority, weight, port sql.NullInt64
+
+		if err := rows.Scan(&record.ID, &record.Name, &record.Type, &ip, &ipv6, &target, &priority, &weight, &port, &content, &record.TTL, &record.DomainID); err != nil {
 			log.Error(err)
+			continue
+		}
+		// either address column may be NULL for single-stack hosts
+		record.IP = ip.String
+		record.IPv6 = ipv6.String
+		record.Target = target.String
+		record.Priority = int(priority.Int64)
+		record.Weight = int(weight.Int64)
+		record.Port = int(port.Int64)
+		record.Text = content.String
+		if record.Name == "" {
+			record.Name = apexName
 		}
+
+		set = append(set, record)
 	}
 
-	return record, nil
+	if len(set) == 0 {
+		log.Warning("Lookup failed but domain was valid.")
+	}
 
+	return set, rows.Err()
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+)
+
+// recordOverhead - approximate bytes a cached record takes besides its strings
+// (struct, map entry, LRU element and expiry item)
+const recordOverhead = 320
+
+// cacheLimits - LRU bookkeeping bounding a RecordMap by entry count and
+// approximate size, guarded by the RecordMap mutex
+type cacheLimits struct {
+	name       string // cache type label for metrics
+	maxEntries int    // 0 is unlimited
+	maxBytes   int64  // 0 is unlimited
+	bytes      int64
+	order      *list.List // lruEntries, most recently used first
+	elements   map[int]*list.Element
+}
+
+// lruEntry - a record tracked by cacheLimits, with the size it was added with
+type lruEntry struct {
+	id   int
+	size int64
+}
+
+func newCacheLimits(name string, maxEntries int, maxBytes int64) *cacheLimits {
+	return &cacheLimits{
+		name:       name,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		elements:   make(map[int]*list.Element),
+	}
+}
+
+// recordSize approximates the memory held by a cached record
+func recordSize(record Record) int64 {
+	return int64(recordOverhead + len(record.Name) + len(record.Type) + len(record.IP) +
+		len(record.IPv6) + len(record.Target) + len(record.Text) + len(record.RR))
+}
+
+func (l *cacheLimits) add(record Record) {
+	l.remove(record.ID)
+	entry := &lruEntry{id: record.ID, size: recordSize(record)}
+	l.elements[record.ID] = l.order.PushFront(entry)
+	l.bytes += entry.size
+}
+
+func (l *cacheLimits) remove(id int) {
+	if e, ok := l.elements[id]; ok {
+		l.order.Remove(e)
+		delete(l.elements, id)
+		l.bytes -= e.Value.(*lruEntry).size
+	}
+}
+
+func (l *cacheLimits) touch(id int) {
+	if e, ok := l.elements[id]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+// over reports whether the cache holds more than its limits allow
+func (l *cacheLimits) over() bool {
+	return (l.maxEntries > 0 && len(l.elements) > l.maxEntries) ||
+		(l.maxBytes > 0 && l.bytes > l.maxBytes)
+}
+
+// oldest returns the id of the least recently used record
+func (l *cacheLimits) oldest() (int, bool) {
+	e := l.order.Back()
+	if e == nil {
+		return 0, false
+	}
+	return e.Value.(*lruEntry).id, true
+}
+
+// evict removes least recently used records until the cache fits its limits
+// again. Records go together with every other record under their name, so no
+// name is left with a partial set - except keep, the owner just added.
+// Returns the evicted ids, r.mu must be held
+func (r *RecordMap) evict(keep Record) []int {
+	var evicted []int
+	for r.limits.over() {
+		id, ok := r.limits.oldest()
+		if !ok {
+			break
+		}
+		victim, ok := r.Records[id]
+		if !ok {
+			// the LRU may track an id the map has already lost
+			r.limits.remove(id)
+			continue
+		}
+		if victim.DomainID == keep.DomainID && strings.EqualFold(victim.Name, keep.Name) {
+			break
+		}
+
+		evicted = append(evicted, r.removeSet(ownerKey(victim.DomainID, victim.Name))...)
+	}
+
+	if len(evicted) > 0 {
+		cacheEvictionCounter.WithLabelValues(r.limits.name).Add(float64(len(evicted)))
+	}
+	return evicted
+}
+
+// Bytes returns the approximate memory held by the cached records
+func (r *RecordMap) Bytes() int64 {
+	if r.limits == nil {
+		return 0
+	}
+
+	var i int64
+	r.mu.Lock()
+	i = r.limits.bytes
+	r.mu.Unlock()
+	return i
+}
@@ -1,12 +1,10 @@
-//To-Do:
-//  - cache + return cname records (currently returns cname on first lookup then returns cached A record)
-//  - ttl returns constant value - should be decremented from cache DOB + time in cache
 package main
 
 import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
@@ -22,6 +20,7 @@ import (
 
 	"github.com/go-redis/redis"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/miekg/dns"
 	"gopkg.in/ini.v1"
 
 	log "github.com/sirupsen/logrus"
@@ -31,19 +30,50 @@ import (
 type Domain struct {
 	ID   int64
 	Name string
+	// SOA fields, see withSOADefaults for the values used when unset
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32 // also the TTL of negative answers
+	TTL     int64  // TTL of the SOA and NS records
+	// Nameservers - comma separated NS set of the zone
+	Nameservers string
 }
 
 // Record -- struct for storing information regarding records
 type Record struct {
 	ID       int
 	Name     string
+	Type     string // one of the recordType* constants
 	IP       string
+	IPv6     string
+	Target   string    // CNAME target, MX exchange or SRV target
+	Priority int       // MX preference or SRV priority
+	Weight   int       // SRV weight
+	Port     int       // SRV port
+	Text     string    // TXT content, either a plain value or "quoted" "strings"
 	TTL      int64     //TTL for caching
+	CacheTTL int64     // cache lifetime forced by a cache policy, 0 caches for TTL
 	Created  time.Time //datetime the record created in database
+	RR       string    // recursive cache only, the cached RR in zone file format without its TTL
+	Negative string    // recursive cache only, NXDOMAIN or NODATA on the SOA of a negative answer
 	DOB      time.Time //time record created, used for cache expiry
+	Hits     int64     // cache hits since the record was cached, used for prefetching
 	DomainID int64
 }
 
+// Record types stored in dns_record.record_type
+const (
+	recordTypeA     = "A" // carries ip_address and/or ipv6_address
+	recordTypeCNAME = "CNAME"
+	recordTypeMX    = "MX"
+	recordTypeTXT   = "TXT"
+	recordTypeSRV   = "SRV"
+)
+
 type DomainMap struct {
 	Domains map[int]Domain
 	mu      *sync.Mutex
@@ -51,19 +81,30 @@ type DomainMap struct {
 
 type RecordMap struct {
 	Records    map[int]Record
+	names      map[string][]int // record ids by ownerKey, the sets of the cache
 	QueryCount int64
 	mu         *sync.Mutex
+	expiry     *ExpiryScheduler
+	limits     *cacheLimits
 }
 
 var domains DomainMap
 var records RecordMap
 
 var domainChannel = make(chan Domain)
-var recursiveDomainChannel = make(chan Domain)
 
-var recursiveDomains DomainMap
+// recursiveRecords - answers to recursive lookups, every question is cached as
+// a set of records named after its recursiveKey
 var recursiveRecords RecordMap
 
+var reverseRecords ReverseMap
+
+// zoneNames - names of each zone's records, answers names that don't exist
+var zoneNames ZoneNameMap
+
+// reverseZones - in-addr.arpa/ip6.arpa zones answered from reverseRecords
+var reverseZones []string
+
 var recordCacheChannel = make(chan Record)
 var recordCachePurgeChannel = make(chan Record)
 var recursiveCacheChannel = make(chan Record)
@@ -75,7 +116,7 @@ var DEBUG = false
 var upstream_servers []string
 var redisClient *redis.Client
 var redisCacheChannelName string
-var dbConn sql.DB
+var dbConn *sql.DB
 var recordQueryCounter = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "uberdns_record_query_total",
@@ -86,6 +127,67 @@ var recordQueryCounter = prometheus.NewCounterVec(
 	},
 )
 
+var responseCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "uberdns_response_total",
+		Help: "Responses by outcome: answer, nxdomain, nodata, backend_failure, upstream_failure or cname_loop",
+	},
+	[]string{
+		"type",
+		"outcome",
+	},
+)
+
+var writeErrorCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "uberdns_write_errors_total",
+		Help: "Responses that could not be written back to the client",
+	},
+	[]string{
+		"protocol",
+	},
+)
+
+var cacheEvictionCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "uberdns_cache_evictions_total",
+		Help: "Records evicted to keep a cache within its size limits",
+	},
+	[]string{
+		"type",
+	},
+)
+
+var negativeCacheHitCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "uberdns_negative_cache_hits_total",
+		Help: "Recursive queries answered from cached NXDOMAIN and NODATA responses",
+	},
+	[]string{
+		"outcome",
+	},
+)
+
+var prefetchCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "uberdns_prefetch_total",
+		Help: "Popular cache entries refreshed ahead of their expiry",
+	},
+	[]string{
+		"type",
+	},
+)
+
+var coalescedLookupCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "uberdns_coalesced_lookups_total",
+		Help: "Cache misses that waited on an identical lookup already in flight",
+	},
+	[]string{
+		"backend",
+	},
+)
+
 func loadConfig(configFile string) (*ini.File, error) {
 	cfg, err := ini.Load(configFile)
 	if err != nil {
@@ -105,6 +207,16 @@ func main() {
 			},
 		)
 
+		recordCacheBytesGauge = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "uberdns_record_cache_bytes",
+				Help: "Approximate memory held by cached records",
+			},
+			[]string{
+				"type",
+			},
+		)
+
 		domainCacheDepthCounter = prometheus.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "uberdns_domain_cache_depth",
@@ -117,13 +229,21 @@ func main() {
 
 	domains.Domains = make(map[int]Domain)
 	domains.mu = new(sync.Mutex)
-	recursiveDomains.Domains = make(map[int]Domain)
-	recursiveDomains.mu = new(sync.Mutex)
 
 	records.Records = make(map[int]Record)
+	records.names = make(map[string][]int)
 	records.mu = new(sync.Mutex)
+	records.expiry = newExpiryScheduler(recordCachePurgeChannel)
 	recursiveRecords.Records = make(map[int]Record)
+	recursiveRecords.names = make(map[string][]int)
 	recursiveRecords.mu = new(sync.Mutex)
+	recursiveRecords.expiry = newExpiryScheduler(recursiveCachePurgeChannel)
+	reverseRecords.Pointers = make(map[string][]Pointer)
+	reverseRecords.targets = make(map[string][]string)
+	reverseRecords.below = make(map[string]int)
+	reverseRecords.mu = new(sync.Mutex)
+	zoneNames.Zones = make(map[int64]*zoneIndex)
+	zoneNames.mu = new(sync.Mutex)
 
 	cfgFile := flag.String("config", "config.ini", "Path to the config file")
 	flag.Parse()
@@ -149,9 +269,38 @@ func main() {
 	logFilename := cfg.Section("dns").Key("log_file").String()
 	DEBUG, _ = cfg.Section("dns").Key("debug").Bool()
 
+	recordsMaxEntries, _ := cfg.Section("cache").Key("authoritative_max_entries").Int()
+	recordsMaxBytes, _ := cfg.Section("cache").Key("authoritative_max_bytes").Int64()
+	records.limits = newCacheLimits("uberdns", recordsMaxEntries, recordsMaxBytes)
+	recursiveMaxEntries, _ := cfg.Section("cache").Key("recursive_max_entries").Int()
+	recursiveMaxBytes, _ := cfg.Section("cache").Key("recursive_max_bytes").Int64()
+	recursiveRecords.limits = newCacheLimits("recurse", recursiveMaxEntries, recursiveMaxBytes)
+	negativeMaxTTL = cfg.Section("cache").Key("negative_max_ttl").MustInt64(negativeMaxTTL)
+	staleWindow = time.Duration(cfg.Section("cache").Key("stale_window").MustInt64(0)) * time.Second
+	prefetchFraction = cfg.Section("cache").Key("prefetch_fraction").MustFloat64(0)
+	prefetchMinHits = cfg.Section("cache").Key("prefetch_min_hits").MustInt64(prefetchMinHits)
+	if cachePolicies, err = loadCachePolicies(cfg); err != nil {
+		panic(err.Error())
+	}
+	snapshotFile := cfg.Section("cache").Key("snapshot_file").String()
+	snapshotInterval := cfg.Section("cache").Key("snapshot_interval").MustDuration(5 * time.Minute)
+
 	upstreamServerList := cfg.Section("dns").Key("upstream_servers").String()
 	upstream_servers = strings.Split(upstreamServerList, ",")
 
+	loadChaosConfig(cfg.Section("dns"))
+
+	anyPolicies := []string{anyPolicyRefuse, anyPolicyMinimal, anyPolicyForward}
+	anyPolicyUDP := cfg.Section("dns").Key("any_policy_udp").In(anyPolicyMinimal, anyPolicies)
+	anyPolicyTCP := cfg.Section("dns").Key("any_policy_tcp").In(anyPolicyMinimal, anyPolicies)
+
+	rrsetOrder = cfg.Section("dns").Key("rrset_order").In(rrsetOrderRoundRobin, []string{rrsetOrderRoundRobin, rrsetOrderRandom, rrsetOrderFixed})
+	rand.Seed(time.Now().UnixNano())
+
+	for _, zone := range cfg.Section("dns").Key("reverse_zones").Strings(",") {
+		reverseZones = append(reverseZones, strings.ToLower(dns.Fqdn(zone)))
+	}
+
 	// Start logger
 	logFile, err := os.OpenFile(logFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 
@@ -197,21 +346,54 @@ func main() {
 	go func() {
 		prometheus.MustRegister(recordCacheDepthCounter)
 		prometheus.MustRegister(domainCacheDepthCounter)
+		prometheus.MustRegister(recordCacheBytesGauge)
+		prometheus.MustRegister(cacheEvictionCounter)
+		prometheus.MustRegister(negativeCacheHitCounter)
+		prometheus.MustRegister(prefetchCounter)
+		prometheus.MustRegister(coalescedLookupCounter)
 		prometheus.MustRegister(recordQueryCounter)
+		prometheus.MustRegister(responseCounter)
+		prometheus.MustRegister(writeErrorCounter)
 		http.Handle("/metrics", promhttp.Handler())
 		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", prometheusPort), nil))
 	}()
 
 	go watchCache(recursiveCacheChannel, recursiveCachePurgeChannel, recursiveRecords)
 	go watchCache(recordCacheChannel, recordCachePurgeChannel, records)
+	go recursiveRecords.expiry.Run()
+	go records.expiry.Run()
 
 	go domainChannelHandler(domainChannel, domains)
-	go domainChannelHandler(recursiveDomainChannel, recursiveDomains)
 
 	dp := make(chan bool, 1)
 	populateData(dp)
 	<-dp
 
+	if len(reverseZones) > 0 {
+		if err := populateReverseData(); err != nil {
+			log.Error(err)
+		}
+	}
+
+	// warm both caches up before the listeners open
+	if snapshotFile != "" {
+		n, err := loadSnapshot(snapshotFile)
+		if err != nil {
+			log.Error(err)
+		}
+		logger("cache").Info(fmt.Sprintf("Restored %d records from snapshot %s", n, snapshotFile))
+
+		go func() {
+			ticker := time.NewTicker(snapshotInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := writeSnapshot(snapshotFile); err != nil {
+					logger("cache").Error(fmt.Sprintf("Failed to write snapshot %s: %s", snapshotFile, err.Error()))
+				}
+			}
+		}()
+	}
+
 	// Clean up records that exceed their TTL
 	go func() {
 		ticker := time.NewTicker(500 * time.Millisecond)
@@ -224,17 +406,21 @@ func main() {
 
 			recordCacheDepthCounter.WithLabelValues("recurse").Set(float64(recursiveRecords.Count()))
 
-			domainCacheDepthCounter.WithLabelValues("recurse").Set(float64(recursiveDomains.Count()))
+			recordCacheBytesGauge.WithLabelValues("uberdns").Set(float64(records.Bytes()))
+
+			recordCacheBytesGauge.WithLabelValues("recurse").Set(float64(recursiveRecords.Bytes()))
+
+			domainCacheDepthCounter.WithLabelValues("recurse").Set(float64(len(recursiveDomains())))
 
 		}
 	}()
 
-	go startListening("tcp", 53)
-	go startListening("udp", 53)
+	go startListening("tcp", 53, anyPolicyTCP)
+	go startListening("udp", 53, anyPolicyUDP)
 
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	for {
-		sig := make(chan os.Signal)
-		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 		s := <-sig
 		switch s {
 		case syscall.SIGHUP:
@@ -252,6 +438,11 @@ func main() {
 			}
 			log.SetOutput(logFile)
 		case syscall.SIGINT, syscall.SIGTERM:
+			if snapshotFile != "" {
+				if err := writeSnapshot(snapshotFile); err != nil {
+					log.Error(fmt.Sprintf("Failed to write snapshot %s: %s", snapshotFile, err.Error()))
+				}
+			}
 			log.Fatalf("Signal (%v) received, stopping\n", s)
 		default:
 			fmt.Printf("Signal %v received", s.String())
@@ -1,9 +1,24 @@
 package main
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/ini.v1"
 )
 
 var testDomains []Domain
@@ -35,3 +50,1107 @@ func TestPopulateData(*testing.T) {
 func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
+
+func TestRecordSetCache(t *testing.T) {
+	var cache RecordMap
+	cache.mu = new(sync.Mutex)
+	cache.Records = make(map[int]Record)
+	cache.names = make(map[string][]int)
+
+	cache.AddRecord(Record{ID: 1, Name: "mail", Type: recordTypeA, IP: "127.0.0.1", DomainID: 1})
+	cache.AddRecord(Record{ID: 2, Name: "mail", Type: recordTypeMX, Target: "mx1.test.com", Priority: 10, DomainID: 1})
+	cache.AddRecord(Record{ID: 3, Name: "mail", Type: recordTypeA, IP: "127.0.0.2", DomainID: 2})
+
+	if n := len(cache.GetRecordsByName("mail", 1)); n != 2 {
+		t.Fatalf("expected 2 records for mail in domain 1, got %d", n)
+	}
+
+	if !cache.Contains(Record{ID: 4, Name: "mail", Type: recordTypeA, IP: "127.0.0.1", DomainID: 1}) {
+		t.Error("identical record under another id should be reported as cached")
+	}
+	if cache.Contains(Record{ID: 5, Name: "mail", Type: recordTypeMX, Target: "mx2.test.com", Priority: 20, DomainID: 1}) {
+		t.Error("second MX for the same name should not be reported as cached")
+	}
+
+	removed := cache.ReplaceSet(1, "mail", []Record{{ID: 6, Name: "mail", Type: recordTypeA, IP: "127.0.0.3", DomainID: 1}})
+	if len(removed) != 2 {
+		t.Errorf("expected the 2 replaced ids back, got %v", removed)
+	}
+	if set := cache.GetRecordsByName("mail", 1); len(set) != 1 || set[0].ID != 6 {
+		t.Fatalf("expected only the new record for mail in domain 1, got %v", set)
+	}
+
+	// an expiry racing a reload that kept the id must not purge the new set
+	expired := Record{ID: 6, Name: "mail", DomainID: 1, DOB: time.Now().Add(-time.Hour)}
+	cache.ReplaceSet(1, "mail", []Record{{ID: 6, Name: "mail", Type: recordTypeA, IP: "127.0.0.3", DomainID: 1, DOB: time.Now()}})
+	if cache.ExpireRecordSet(expired) || len(cache.GetRecordsByName("mail", 1)) != 1 {
+		t.Fatal("expected the reloaded set to survive the expiry of the old one")
+	}
+	expired.DOB = cache.GetRecordByID(6).DOB
+	if !cache.ExpireRecordSet(expired) || cache.Count() != 1 {
+		t.Fatalf("expected the expiry to purge the set it was scheduled for, %d records left", cache.Count())
+	}
+	cache.AddRecord(Record{ID: 6, Name: "mail", Type: recordTypeA, IP: "127.0.0.3", DomainID: 1})
+
+	cache.DeleteRecordSet(Record{ID: 6, Name: "mail", DomainID: 1})
+	if cache.Count() != 1 {
+		t.Fatalf("expected only the other domain's record to remain, got %d", cache.Count())
+	}
+}
+
+func TestTXTStrings(t *testing.T) {
+	long := strings.Repeat("a", 300)
+
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"v=spf1 -all", []string{"v=spf1 -all"}},
+		{`"v=DKIM1; k=rsa;" "p=abc"`, []string{"v=DKIM1; k=rsa;", "p=abc"}},
+		{`"say \"hi\""`, []string{`say "hi"`}},
+		{`back\slash`, []string{`back\\slash`}},
+		{long, []string{long[:255], long[255:]}},
+		{"", []string{""}},
+	}
+
+	for _, test := range tests {
+		got := txtStrings(test.content)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("txtStrings(%q) = %q, want %q", test.content, got, test.want)
+		}
+	}
+}
+
+func TestNegativeSOA(t *testing.T) {
+	domain := Domain{ID: 1, Name: "test.com", Nameservers: "ns1.test.com, ns2.test.com"}.withSOADefaults()
+
+	if domain.MName != "ns1.test.com." {
+		t.Errorf("expected mname to default to the first nameserver, got %s", domain.MName)
+	}
+	if n := len(domain.nsRRs()); n != 2 {
+		t.Errorf("expected 2 NS records, got %d", n)
+	}
+	if ttl := domain.negativeSOA().Hdr.Ttl; ttl != defaultSOAMinimum {
+		t.Errorf("expected negative TTL %d, got %d", defaultSOAMinimum, ttl)
+	}
+}
+
+func TestReverseIndex(t *testing.T) {
+	reverseZones = []string{"10.in-addr.arpa.", "8.b.d.0.1.0.0.2.ip6.arpa."}
+	reverseRecords.Pointers = make(map[string][]Pointer)
+	reverseRecords.targets = make(map[string][]string)
+	reverseRecords.below = make(map[string]int)
+	reverseRecords.mu = new(sync.Mutex)
+
+	domain := Domain{ID: 1, Name: "test.com"}
+	indexRecord(Record{Name: "host", Type: recordTypeA, IP: "10.1.2.3", IPv6: "2001:db8::1", TTL: 60, DomainID: 1}, domain)
+	indexRecord(Record{Name: "public", Type: recordTypeA, IP: "192.0.2.1", TTL: 60, DomainID: 1}, domain)
+	indexRecord(Record{Name: "*.app", Type: recordTypeA, IP: "10.9.9.9", TTL: 60, DomainID: 1}, domain)
+
+	if p := reverseRecords.GetPointers("3.2.1.10.in-addr.arpa."); len(p) != 1 || p[0].Target != "host.test.com." {
+		t.Errorf("expected PTR to host.test.com., got %v", p)
+	}
+	if p := reverseRecords.GetPointers("1.2.0.192.in-addr.arpa."); len(p) != 0 {
+		t.Errorf("addresses outside our reverse zones should not be indexed, got %v", p)
+	}
+	if p := reverseRecords.GetPointers("9.9.9.10.in-addr.arpa."); len(p) != 0 {
+		t.Errorf("wildcard owners should not be indexed, got %v", p)
+	}
+	if !reverseRecords.HasDescendant("1.10.in-addr.arpa.") {
+		t.Error("expected 1.10.in-addr.arpa. to be an empty non-terminal")
+	}
+	if zone := getReverseZone("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."); zone != "8.b.d.0.1.0.0.2.ip6.arpa." {
+		t.Errorf("unexpected reverse zone %q", zone)
+	}
+
+	// reloading a name rebuilds its PTRs from the new set
+	reindexName("HOST", domain, []Record{{Name: "host", Type: recordTypeA, IP: "10.1.2.4", TTL: 60, DomainID: 1}})
+	if p := reverseRecords.GetPointers("3.2.1.10.in-addr.arpa."); len(p) != 0 {
+		t.Errorf("expected the old address to lose its PTR, got %v", p)
+	}
+	if p := reverseRecords.GetPointers("4.2.1.10.in-addr.arpa."); len(p) != 1 || p[0].Target != "host.test.com." {
+		t.Errorf("expected PTR for the new address to host.test.com., got %v", p)
+	}
+
+	reindexName("host", domain, nil)
+	if reverseRecords.Count() != 0 {
+		t.Errorf("expected an empty index, got %d names", reverseRecords.Count())
+	}
+	if reverseRecords.HasDescendant("10.in-addr.arpa.") {
+		t.Error("expected no empty non-terminals left once every PTR is gone")
+	}
+}
+
+func TestReverseAnswer(t *testing.T) {
+	reverseZones = []string{"10.in-addr.arpa."}
+	reverseRecords.Pointers = make(map[string][]Pointer)
+	reverseRecords.targets = make(map[string][]string)
+	reverseRecords.below = make(map[string]int)
+	reverseRecords.mu = new(sync.Mutex)
+	indexRecord(Record{Name: "host", Type: recordTypeA, IP: "10.1.2.3", TTL: 60, DomainID: 1}, Domain{ID: 1, Name: "test.com"})
+
+	tests := []struct {
+		fqdn    string
+		qtype   uint16
+		rcode   int
+		answers []string
+		soa     bool
+	}{
+		{"3.2.1.10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"PTR host.test.com."}, false},
+		{"3.2.1.10.in-addr.arpa.", dns.TypeA, dns.RcodeSuccess, nil, true},
+		// empty non-terminal
+		{"2.1.10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, nil, true},
+		{"4.2.1.10.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, nil, true},
+		{"10.in-addr.arpa.", dns.TypeSOA, dns.RcodeSuccess, []string{"SOA ns1.10.in-addr.arpa. hostmaster.10.in-addr.arpa."}, false},
+	}
+
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		reverseAnswer(msg, test.fqdn, test.qtype, getReverseZone(test.fqdn))
+		answers := rrData(msg.Answer)
+		if test.qtype == dns.TypeSOA && len(answers) == 1 {
+			// only compare the names, serial and timers are defaults
+			answers[0] = strings.Join(strings.Fields(answers[0])[:3], " ")
+		}
+		if msg.Rcode != test.rcode || !reflect.DeepEqual(answers, test.answers) || (len(msg.Ns) == 1) != test.soa {
+			t.Errorf("%s %s: got %s %q with %d authority RRs, want %s %q", test.fqdn, dns.Type(test.qtype),
+				dns.RcodeToString[msg.Rcode], answers, len(msg.Ns), dns.RcodeToString[test.rcode], test.answers)
+		}
+	}
+}
+
+func TestZoneNames(t *testing.T) {
+	zoneNames.Zones = make(map[int64]*zoneIndex)
+	zoneNames.mu = new(sync.Mutex)
+
+	domain := Domain{ID: 1, Name: "test.com"}
+	zoneNames.Store(domain.ID, []string{"", "WWW", "a.b.c", "*.app"})
+	zoneNames.Add(domain.ID, "new")
+
+	tests := []struct {
+		name          string
+		exists, below bool
+	}{
+		{apexName, true, false},
+		{"www", true, false},
+		{"new", true, false},
+		{"b.c", false, true},
+		{"c", false, true},
+		{"app", false, true},
+		{"*.app", true, false},
+		{"missing", false, false},
+	}
+
+	for _, test := range tests {
+		exists, below, err := zoneNames.Lookup(test.name, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != test.exists || below != test.below {
+			t.Errorf("Lookup(%s) = %v, %v, want %v, %v", test.name, exists, below, test.exists, test.below)
+		}
+	}
+
+	// after a failed reload the old index answers without asking MySQL again
+	zoneNames.Zones[domain.ID].loaded = time.Now().Add(-time.Hour)
+	zoneNames.backoff(domain.ID, time.Duration(defaultSOAMinimum)*time.Second)
+	if exists, _, err := zoneNames.Lookup("www", domain); err != nil || !exists {
+		t.Errorf("expected the old index to answer, got %v, %v", exists, err)
+	}
+
+	zoneNames.Forget(domain.ID)
+	zoneNames.Add(domain.ID, "www")
+	if len(zoneNames.Zones) != 0 {
+		t.Error("names created in a zone that isn't indexed should not create an index")
+	}
+}
+
+var recordCacheOnce sync.Once
+
+// resetRecordCache empties the authoritative cache, watched like in main so
+// redis purges reach it
+func resetRecordCache() {
+	recordCacheOnce.Do(func() {
+		records = RecordMap{
+			Records: make(map[int]Record),
+			names:   make(map[string][]int),
+			mu:      new(sync.Mutex),
+			expiry:  newExpiryScheduler(recordCachePurgeChannel),
+		}
+		go watchCache(recordCacheChannel, recordCachePurgeChannel, records)
+	})
+	records.Purge(func(Record) bool { return true })
+}
+
+// fakeDBRows - the rows every query against the fake driver returns, it
+// stands in for MySQL where a test needs the database
+var fakeDBRows [][]driver.Value
+
+func init() {
+	sql.Register("fake", fakeDriver{})
+}
+
+type fakeDriver struct{}
+type fakeConn struct{}
+type fakeStmt struct{}
+type fakeRows struct{ rows [][]driver.Value }
+
+func (fakeDriver) Open(string) (driver.Conn, error)  { return fakeConn{}, nil }
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return fakeStmt{}, nil }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("fake: no transactions") }
+func (fakeStmt) Close() error                        { return nil }
+func (fakeStmt) NumInput() int                       { return -1 }
+
+func (fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("fake: read only")
+}
+
+func (fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &fakeRows{rows: fakeDBRows}, nil
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// useFakeDB points dbConn at the fake driver answering with rows until the
+// returned function restores it
+func useFakeDB(t *testing.T, rows [][]driver.Value) func() {
+	db, err := sql.Open("fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := dbConn
+	dbConn, fakeDBRows = db, rows
+	return func() { dbConn, fakeDBRows = old, nil }
+}
+
+// seedZones serves example.com and example.net from records, cached fresh and
+// indexed so answering never reaches MySQL
+func seedZones(set []Record) {
+	domains.mu = new(sync.Mutex)
+	domains.Domains = map[int]Domain{
+		1: Domain{ID: 1, Name: "example.com", Nameservers: "ns1.example.com, ns2.example.org"}.withSOADefaults(),
+		2: Domain{ID: 2, Name: "example.net"}.withSOADefaults(),
+	}
+
+	resetRecordCache()
+	reverseRecords.Pointers = make(map[string][]Pointer)
+	reverseRecords.targets = make(map[string][]string)
+	reverseRecords.below = make(map[string]int)
+	reverseRecords.mu = new(sync.Mutex)
+	zoneNames.Zones = make(map[int64]*zoneIndex)
+	zoneNames.mu = new(sync.Mutex)
+
+	names := make(map[int64][]string)
+	for i := range set {
+		set[i].ID = i + 1
+		set[i].TTL = 300
+		set[i].DOB = time.Now()
+		records.AddRecord(set[i])
+		names[set[i].DomainID] = append(names[set[i].DomainID], set[i].Name)
+	}
+	for id := range domains.Domains {
+		zoneNames.Store(int64(id), names[int64(id)])
+	}
+}
+
+// rrData returns the type and data of each RR, without owner and TTL
+func rrData(rrs []dns.RR) []string {
+	var data []string
+	for _, rr := range rrs {
+		data = append(data, dns.Type(rr.Header().Rrtype).String()+" "+strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	return data
+}
+
+// answerTest - an authoritativeAnswer case, authority counts the RRs
+// expected in the authority section
+type answerTest struct {
+	fqdn      string
+	qtype     uint16
+	rcode     int
+	answers   []string
+	extra     []string
+	authority int
+}
+
+func runAnswerTests(t *testing.T, tests []answerTest) {
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		name, domain := findZone(test.fqdn)
+		if err := authoritativeAnswer(msg, test.fqdn, test.qtype, name, domain); err != nil {
+			t.Fatalf("%s %s: %s", test.fqdn, dns.Type(test.qtype), err)
+		}
+		answers, extra := rrData(msg.Answer), rrData(msg.Extra)
+		if msg.Rcode != test.rcode || !reflect.DeepEqual(answers, test.answers) || !reflect.DeepEqual(extra, test.extra) || len(msg.Ns) != test.authority {
+			t.Errorf("%s %s: got %s %q extra %q with %d authority RRs, want %s %q extra %q with %d", test.fqdn, dns.Type(test.qtype),
+				dns.RcodeToString[msg.Rcode], answers, extra, len(msg.Ns), dns.RcodeToString[test.rcode], test.answers, test.extra, test.authority)
+		}
+	}
+}
+
+func TestApexAnswer(t *testing.T) {
+	seedZones([]Record{
+		{Name: "ns1", Type: recordTypeA, IP: "10.0.0.53", DomainID: 1},
+		{Name: apexName, Type: recordTypeTXT, Text: "apex", DomainID: 2},
+	})
+	soa := rrData([]dns.RR{domains.GetDomainByID(1).soaRR()})
+
+	runAnswerTests(t, []answerTest{
+		{"example.com.", dns.TypeSOA, dns.RcodeSuccess, soa, nil, 0},
+		// in-zone nameservers come with their addresses
+		{"example.com.", dns.TypeNS, dns.RcodeSuccess, []string{"NS ns1.example.com.", "NS ns2.example.org."}, []string{"A 10.0.0.53"}, 0},
+		{"example.com.", dns.TypeANY, dns.RcodeSuccess, soa, nil, 0},
+		// no nameservers in dns_domain, NODATA with the SOA
+		{"example.net.", dns.TypeNS, dns.RcodeSuccess, nil, nil, 1},
+	})
+}
+
+func TestAddressAnswer(t *testing.T) {
+	seedZones([]Record{
+		{Name: "v6", Type: recordTypeA, IPv6: "2001:db8::6", DomainID: 1},
+		{Name: "dual", Type: recordTypeA, IP: "10.0.0.4", IPv6: "2001:db8::4", DomainID: 1},
+		{Name: "v4", Type: recordTypeA, IP: "10.0.0.5", DomainID: 1},
+	})
+
+	runAnswerTests(t, []answerTest{
+		{"v6.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA 2001:db8::6"}, nil, 0},
+		{"v6.example.com.", dns.TypeA, dns.RcodeSuccess, nil, nil, 1},
+		{"dual.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.4"}, nil, 0},
+		{"dual.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA 2001:db8::4"}, nil, 0},
+		// IPv4-only names are NODATA for AAAA, with the SOA
+		{"v4.example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil, nil, 1},
+	})
+}
+
+func TestMXAnswer(t *testing.T) {
+	seedZones([]Record{
+		{Name: apexName, Type: recordTypeMX, Target: "mail.example.com", Priority: 10, DomainID: 1},
+		{Name: apexName, Type: recordTypeMX, Target: "mx.example.org", Priority: 20, DomainID: 1},
+		{Name: "mail", Type: recordTypeA, IP: "10.0.0.25", IPv6: "2001:db8::25", DomainID: 1},
+	})
+	defer func(order string) { rrsetOrder = order }(rrsetOrder)
+	rrsetOrder = rrsetOrderFixed
+
+	runAnswerTests(t, []answerTest{
+		// in-zone exchanges come with their addresses, out-of-zone ones don't
+		{"example.com.", dns.TypeMX, dns.RcodeSuccess, []string{"MX 10 mail.example.com.", "MX 20 mx.example.org."}, []string{"A 10.0.0.25", "AAAA 2001:db8::25"}, 0},
+	})
+}
+
+func TestSRVAnswer(t *testing.T) {
+	seedZones([]Record{
+		{Name: "_sip._tcp", Type: recordTypeSRV, Target: "sip.example.com", Priority: 10, Weight: 5, Port: 5060, DomainID: 1},
+		{Name: "sip", Type: recordTypeA, IP: "10.0.0.7", IPv6: "2001:db8::7", DomainID: 1},
+		{Name: "_xmpp._tcp", Type: recordTypeSRV, Target: "xmpp.example.org", Priority: 0, Weight: 0, Port: 5222, DomainID: 1},
+	})
+
+	runAnswerTests(t, []answerTest{
+		// in-zone targets come with their addresses
+		{"_sip._tcp.example.com.", dns.TypeSRV, dns.RcodeSuccess, []string{"SRV 10 5 5060 sip.example.com."}, []string{"A 10.0.0.7", "AAAA 2001:db8::7"}, 0},
+		{"_xmpp._tcp.example.com.", dns.TypeSRV, dns.RcodeSuccess, []string{"SRV 0 0 5222 xmpp.example.org."}, nil, 0},
+	})
+}
+
+func TestApexRecords(t *testing.T) {
+	seedZones([]Record{{Name: apexName, Type: recordTypeA, IP: "10.0.0.1", DomainID: 2}})
+	runAnswerTests(t, []answerTest{
+		{"example.net.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1"}, nil, 0},
+	})
+
+	// a legacy apex row with an empty name, created through redis with its
+	// empty name too, is cached and served as @
+	defer useFakeDB(t, [][]driver.Value{
+		{int64(7), "", "A", "10.0.0.9", nil, nil, nil, nil, nil, nil, int64(300), int64(1)},
+	})()
+	if set, err := getRecordsFromHost(apexName, 1); err != nil || len(set) != 1 || set[0].Name != apexName {
+		t.Fatalf("expected the legacy row under %s, got %v, %v", apexName, set, err)
+	}
+
+	object := `{"ID": 7, "Name": "", "Type": "A", "IP": "10.0.0.9", "TTL": 300, "DomainID": 1}`
+	cacheMessageHandler(CacheControlMessage{Action: "create", Type: "record", Object: object})
+	if set := records.GetRecordsByName(apexName, 1); len(set) != 1 || set[0].ID != 7 {
+		t.Fatalf("expected the created apex record cached under %s, got %v", apexName, set)
+	}
+	runAnswerTests(t, []answerTest{
+		{"example.com.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.9"}, nil, 0},
+	})
+
+	// purges reach the cache through watchCache
+	cacheMessageHandler(CacheControlMessage{Action: "purge", Type: "record", Object: object})
+	for i := 0; i < 100 && len(records.GetRecordsByName(apexName, 1)) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if set := records.GetRecordsByName(apexName, 1); len(set) != 0 {
+		t.Errorf("expected the purge to drop the apex record, got %v", set)
+	}
+}
+
+func TestCNAMEChain(t *testing.T) {
+	set := []Record{
+		{Name: "www", Type: recordTypeCNAME, Target: "web.example.com", DomainID: 1},
+		{Name: "web", Type: recordTypeA, IP: "10.0.0.1", DomainID: 1},
+		{Name: "cross", Type: recordTypeCNAME, Target: "www.example.net", DomainID: 1},
+		{Name: "www", Type: recordTypeA, IP: "10.0.1.1", DomainID: 2},
+		{Name: "loop1", Type: recordTypeCNAME, Target: "loop2.example.com", DomainID: 1},
+		{Name: "loop2", Type: recordTypeCNAME, Target: "LOOP1.example.com", DomainID: 1},
+		{Name: "out", Type: recordTypeCNAME, Target: "www.example.org", DomainID: 1},
+	}
+	// k0 -> ... -> k8 is maxCNAMEChain CNAMEs long, l0 -> ... -> l9 one more
+	for i := 0; i < maxCNAMEChain; i++ {
+		set = append(set, Record{Name: fmt.Sprintf("k%d", i), Type: recordTypeCNAME, Target: fmt.Sprintf("k%d.example.com", i+1), DomainID: 1})
+	}
+	set = append(set, Record{Name: fmt.Sprintf("k%d", maxCNAMEChain), Type: recordTypeA, IP: "10.0.0.2", DomainID: 1})
+	for i := 0; i <= maxCNAMEChain; i++ {
+		set = append(set, Record{Name: fmt.Sprintf("l%d", i), Type: recordTypeCNAME, Target: fmt.Sprintf("l%d.example.com", i+1), DomainID: 1})
+	}
+	set = append(set, Record{Name: fmt.Sprintf("l%d", maxCNAMEChain+1), Type: recordTypeA, IP: "10.0.0.3", DomainID: 1})
+	seedZones(set)
+	resetRecursiveCache()
+
+	// no upstream servers, out-of-zone targets fail to resolve
+	defer func(servers []string) { upstream_servers = servers }(upstream_servers)
+	upstream_servers = nil
+
+	tests := []struct {
+		fqdn    string
+		qtype   uint16
+		rcode   int
+		err     error
+		answers int
+		last    string
+	}{
+		{"www.example.com.", dns.TypeA, dns.RcodeSuccess, nil, 2, "A 10.0.0.1"},
+		{"www.example.com.", dns.TypeCNAME, dns.RcodeSuccess, nil, 1, "CNAME web.example.com."},
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil, 1, "CNAME web.example.com."},
+		{"cross.example.com.", dns.TypeA, dns.RcodeSuccess, nil, 2, "A 10.0.1.1"},
+		{"loop1.example.com.", dns.TypeA, dns.RcodeServerFailure, errCNAMELoop, 2, "CNAME LOOP1.example.com."},
+		{"k0.example.com.", dns.TypeA, dns.RcodeSuccess, nil, maxCNAMEChain + 1, "A 10.0.0.2"},
+		{"l0.example.com.", dns.TypeA, dns.RcodeServerFailure, errCNAMELoop, maxCNAMEChain + 1, "CNAME l9.example.com."},
+		{"out.example.com.", dns.TypeA, dns.RcodeServerFailure, errUpstreamFailed, 1, "CNAME www.example.org."},
+	}
+
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		name, domain := findZone(test.fqdn)
+		err := authoritativeAnswer(msg, test.fqdn, test.qtype, name, domain)
+		answers := rrData(msg.Answer)
+		if err != test.err || msg.Rcode != test.rcode || len(answers) != test.answers || answers[len(answers)-1] != test.last {
+			t.Errorf("%s %s: got %s %v %q, want %s %v %d answers ending in %q", test.fqdn, dns.Type(test.qtype),
+				dns.RcodeToString[msg.Rcode], err, answers, dns.RcodeToString[test.rcode], test.err, test.answers, test.last)
+		}
+	}
+
+	// out-of-zone targets go through the recursive cache, so once upstream
+	// answered the chain is finished without asking it again
+	cacheResponse(recursiveKey("www.example.org.", dns.TypeA, dns.ClassINET), &dns.Msg{Answer: []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "www.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 10)},
+	}})
+	msg := new(dns.Msg)
+	if err := authoritativeAnswer(msg, "out.example.com.", dns.TypeA, "out", domains.GetDomainByID(1)); err != nil {
+		t.Fatal(err)
+	}
+	if answers := rrData(msg.Answer); !reflect.DeepEqual(answers, []string{"CNAME www.example.org.", "A 192.0.2.10"}) {
+		t.Errorf("expected the cached upstream answer to finish the chain, got %q", answers)
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	seedZones([]Record{
+		{Name: "*.app", Type: recordTypeA, IP: "10.0.2.1", DomainID: 1},
+		{Name: "explicit.app", Type: recordTypeA, IP: "10.0.2.2", DomainID: 1},
+		{Name: "explicit.app", Type: recordTypeTXT, Text: "hello", DomainID: 1},
+		{Name: "x.ent.app", Type: recordTypeA, IP: "10.0.2.3", DomainID: 1},
+		{Name: "*", Type: recordTypeTXT, Text: "catch-all", DomainID: 2},
+	})
+
+	tests := []struct {
+		fqdn    string
+		qtype   uint16
+		rcode   int
+		answers []string
+	}{
+		// synthesized from the wildcard, owned by the query name
+		{"foo.app.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.2.1"}},
+		{"a.b.app.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.2.1"}},
+		{"foo.app.example.com.", dns.TypeMX, dns.RcodeSuccess, nil},
+		// names with records of their own never match the wildcard
+		{"explicit.app.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.2.2"}},
+		{"explicit.app.example.com.", dns.TypeAAAA, dns.RcodeSuccess, nil},
+		// empty non-terminals exist, and are the closest encloser of names below them
+		{"ent.app.example.com.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"y.ent.app.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+		{"foo.example.com.", dns.TypeA, dns.RcodeNameError, nil},
+		{"foo.example.net.", dns.TypeTXT, dns.RcodeSuccess, []string{"TXT \"catch-all\""}},
+	}
+
+	for _, test := range tests {
+		msg := new(dns.Msg)
+		name, domain := findZone(test.fqdn)
+		if err := authoritativeAnswer(msg, test.fqdn, test.qtype, name, domain); err != nil {
+			t.Fatalf("%s %s: %s", test.fqdn, dns.Type(test.qtype), err)
+		}
+		answers := rrData(msg.Answer)
+		if msg.Rcode != test.rcode || !reflect.DeepEqual(answers, test.answers) {
+			t.Errorf("%s %s: got %s %q, want %s %q", test.fqdn, dns.Type(test.qtype),
+				dns.RcodeToString[msg.Rcode], answers, dns.RcodeToString[test.rcode], test.answers)
+		}
+		for _, rr := range msg.Answer {
+			if rr.Header().Name != test.fqdn {
+				t.Errorf("%s %s: answer owned by %s", test.fqdn, dns.Type(test.qtype), rr.Header().Name)
+			}
+		}
+	}
+}
+
+func TestOrderRRset(t *testing.T) {
+	newSet := func() []dns.RR {
+		var rrs []dns.RR
+		for i, ttl := range []uint32{300, 60, 120} {
+			rrs = append(rrs, &dns.A{
+				Hdr: dns.RR_Header{Name: "www.test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   net.IPv4(10, 0, 0, byte(i+1)),
+			})
+		}
+		return rrs
+	}
+
+	for _, rr := range normalizeTTL(newSet()) {
+		if rr.Header().Ttl != 60 {
+			t.Fatalf("expected every RR to carry the lowest TTL, got %d", rr.Header().Ttl)
+		}
+	}
+
+	rrsetOrder = rrsetOrderRoundRobin
+	first := orderRRset(newSet())[0].(*dns.A).A.String()
+	second := orderRRset(newSet())[0].(*dns.A).A.String()
+	if first == second {
+		t.Errorf("expected round-robin to rotate the set, got %s twice", first)
+	}
+
+	rrsetOrder = rrsetOrderFixed
+	if ip := orderRRset(newSet())[0].(*dns.A).A.String(); ip != "10.0.0.1" {
+		t.Errorf("expected fixed order to keep the first record first, got %s", ip)
+	}
+}
+
+func TestFindZone(t *testing.T) {
+	domains.mu = new(sync.Mutex)
+	domains.Domains = map[int]Domain{
+		1: {ID: 1, Name: "example.com"},
+		2: {ID: 2, Name: "dev.example.com"},
+		3: {ID: 3, Name: "example.co.uk"},
+	}
+
+	tests := []struct {
+		fqdn     string
+		name     string
+		domainID int64
+	}{
+		{"a.b.example.com.", "a.b", 1},
+		{"Example.COM.", apexName, 1},
+		{"www.dev.example.com.", "www", 2},
+		{"www.example.co.uk.", "www", 3},
+		{"www.example.org.", "", 0},
+	}
+
+	for _, test := range tests {
+		name, domain := findZone(test.fqdn)
+		if name != test.name || domain.ID != test.domainID {
+			t.Errorf("findZone(%s) = %q in domain %d, want %q in domain %d", test.fqdn, name, domain.ID, test.name, test.domainID)
+		}
+	}
+}
+
+func TestResponseOutcome(t *testing.T) {
+	answer := &dns.A{Hdr: dns.RR_Header{Name: "www.test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(10, 0, 0, 1)}
+
+	tests := []struct {
+		msg  dns.Msg
+		err  error
+		want string
+	}{
+		{dns.Msg{Answer: []dns.RR{answer}}, nil, outcomeAnswer},
+		{dns.Msg{}, nil, outcomeNoData},
+		{dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}, nil, outcomeNXDomain},
+		{dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}, errUpstreamFailed, outcomeUpstreamFailure},
+		{dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}, errCNAMELoop, outcomeCNAMELoop},
+		{dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}, sql.ErrConnDone, outcomeBackendFailure},
+	}
+
+	for _, test := range tests {
+		if got := responseOutcome(&test.msg, test.err); got != test.want {
+			t.Errorf("responseOutcome(%s, %v) = %s, want %s", dns.RcodeToString[test.msg.Rcode], test.err, got, test.want)
+		}
+	}
+}
+
+func TestValidateQuery(t *testing.T) {
+	query := new(dns.Msg).SetQuestion("www.test.com.", dns.TypeA)
+	if rcode := validateQuery(query); rcode != dns.RcodeSuccess {
+		t.Errorf("expected a plain query to be accepted, got %s", dns.RcodeToString[rcode])
+	}
+
+	empty := query.Copy()
+	empty.Question = nil
+	multiple := query.Copy()
+	multiple.Question = append(multiple.Question, query.Question[0])
+	notify := query.Copy()
+	notify.Opcode = dns.OpcodeNotify
+	hesiod := query.Copy()
+	hesiod.Question[0].Qclass = dns.ClassHESIOD
+
+	tests := map[*dns.Msg]int{
+		empty:    dns.RcodeFormatError,
+		multiple: dns.RcodeFormatError,
+		notify:   dns.RcodeNotImplemented,
+		hesiod:   dns.RcodeNotImplemented,
+	}
+	for msg, want := range tests {
+		if rcode := validateQuery(msg); rcode != want {
+			t.Errorf("expected %s, got %s", dns.RcodeToString[want], dns.RcodeToString[rcode])
+		}
+	}
+}
+
+func TestChaosAnswer(t *testing.T) {
+	cfg, err := ini.Load([]byte("[dns]\nchaos_version = test\nchaos_id =\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadChaosConfig(cfg.Section("dns"))
+
+	msg := new(dns.Msg)
+	chaosAnswer(msg, "VERSION.BIND.", dns.TypeTXT)
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.TXT).Txt[0] != "test" {
+		t.Errorf("expected version.bind to answer test, got %v", msg.Answer)
+	}
+
+	msg = new(dns.Msg)
+	chaosAnswer(msg, "id.server.", dns.TypeTXT)
+	if msg.Rcode != dns.RcodeRefused {
+		t.Errorf("expected an empty chaos_id to be refused, got %s", dns.RcodeToString[msg.Rcode])
+	}
+}
+
+func TestAnyMinimalAnswer(t *testing.T) {
+	set := []Record{
+		{ID: 1, Name: "mail", Type: recordTypeMX, Target: "mx1.test.com", Priority: 10},
+		{ID: 2, Name: "mail", Type: recordTypeA, IP: "10.0.0.1"},
+	}
+	if rrtype := anyRRsetType(set); rrtype != dns.TypeMX {
+		t.Errorf("expected ANY to pick the MX RRset, got %s", dns.TypeToString[rrtype])
+	}
+
+	rrs := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "www.test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(10, 0, 0, 1)},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "www.test.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP("2001:db8::1")},
+		&dns.A{Hdr: dns.RR_Header{Name: "www.test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(10, 0, 0, 2)},
+	}
+	if minimal := minimalRRset(rrs); len(minimal) != 2 {
+		t.Errorf("expected only the A RRset to remain, got %v", minimal)
+	}
+}
+
+func TestRemainingTTL(t *testing.T) {
+	record := Record{TTL: 300, DOB: time.Now().Add(-100 * time.Second)}
+	if ttl := record.remainingTTL(); ttl < 199 || ttl > 200 {
+		t.Errorf("expected about 200s left, got %d", ttl)
+	}
+
+	record.DOB = time.Now().Add(-time.Hour)
+	if ttl := record.remainingTTL(); ttl != staleTTL {
+		t.Errorf("expected a stale record to get a TTL of %d, got %d", staleTTL, ttl)
+	}
+}
+
+func TestExpiryScheduler(t *testing.T) {
+	purge := make(chan Record, 3)
+	expiry := newExpiryScheduler(purge)
+	go expiry.Run()
+
+	expiry.Schedule(Record{ID: 1}, time.Hour)
+	expiry.Schedule(Record{ID: 2}, time.Hour)
+	expiry.Schedule(Record{ID: 3}, time.Hour)
+
+	// refresh one record to expire right away and cancel another
+	expiry.Schedule(Record{ID: 2}, 10*time.Millisecond)
+	expiry.Cancel(3)
+
+	select {
+	case record := <-purge:
+		if record.ID != 2 {
+			t.Errorf("expected record 2 to expire first, got %d", record.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("refreshed record never expired")
+	}
+
+	if n := expiry.Count(); n != 1 {
+		t.Errorf("expected 1 pending expiry, got %d", n)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := RecordMap{
+		Records: make(map[int]Record),
+		names:   make(map[string][]int),
+		mu:      new(sync.Mutex),
+		limits:  newCacheLimits("test", 3, 0),
+	}
+
+	cache.AddRecord(Record{ID: 1, Name: "a", IP: "192.0.2.1", DomainID: 1})
+	cache.AddRecord(Record{ID: 2, Name: "a", IP: "192.0.2.2", DomainID: 1})
+	cache.AddRecord(Record{ID: 3, Name: "b", IP: "192.0.2.3", DomainID: 1})
+
+	// a hit on b leaves the whole "a" set as least recently used
+	cache.GetRecordsByName("b", 1)
+	cache.AddRecord(Record{ID: 4, Name: "c", IP: "192.0.2.4", DomainID: 1})
+
+	if set := cache.GetRecordsByName("a", 1); len(set) != 0 {
+		t.Errorf("expected the a set to be evicted, got %v", set)
+	}
+	if n := cache.Count(); n != 2 {
+		t.Errorf("expected 2 cached records, got %d", n)
+	}
+	if b := cache.Bytes(); b != recordSize(Record{Name: "b", IP: "192.0.2.3"})+recordSize(Record{Name: "c", IP: "192.0.2.4"}) {
+		t.Errorf("unexpected cache size %d", b)
+	}
+}
+
+var recursiveCacheOnce sync.Once
+
+// resetRecursiveCache empties the recursive cache, setting it up on first use
+func resetRecursiveCache() {
+	recursiveCacheOnce.Do(func() {
+		recursiveRecords = RecordMap{
+			Records: make(map[int]Record),
+			names:   make(map[string][]int),
+			mu:      new(sync.Mutex),
+			expiry:  newExpiryScheduler(recursiveCachePurgeChannel),
+		}
+		go watchCache(recursiveCacheChannel, recursiveCachePurgeChannel, recursiveRecords)
+	})
+	recursiveRecords.Purge(func(Record) bool { return true })
+}
+
+func TestRecursiveCache(t *testing.T) {
+	resetRecursiveCache()
+
+	var answer []dns.RR
+	for _, s := range []string{
+		"www.example.org. 300 IN CNAME web.example.org.",
+		"web.example.org. 60 IN A 192.0.2.1",
+		"web.example.org. 60 IN A 192.0.2.2",
+	} {
+		rr, _ := dns.NewRR(s)
+		answer = append(answer, rr)
+	}
+
+	key := recursiveKey("WWW.example.org.", dns.TypeA, dns.ClassINET)
+	if other := recursiveKey("www.example.org.", dns.TypeAAAA, dns.ClassINET); key == other {
+		t.Fatal("A and AAAA answers should be cached under different keys")
+	}
+	// SVCB/HTTPS and private types are unknown to the dns package
+	if recursiveKey("a.example.org.", 65, dns.ClassINET) == recursiveKey("a.example.org.", 65280, dns.ClassINET) {
+		t.Fatal("unknown types should be cached under different keys")
+	}
+	cacheResponse(key, &dns.Msg{Answer: answer})
+
+	var msg dns.Msg
+	if !cachedResponse(&msg, "WWW.example.org.", recursiveRecords.GetRecordsByName(key, 0)) {
+		t.Fatal("expected a cached answer")
+	}
+	if names := recursiveDomains(); !reflect.DeepEqual(names, []string{"www.example.org"}) {
+		t.Errorf("expected www.example.org as the only recursive domain, got %v", names)
+	}
+	cached := msg.Answer
+	if len(cached) != len(answer) {
+		t.Fatalf("expected %d cached RRs, got %d", len(answer), len(cached))
+	}
+	for i := range cached {
+		if cached[i].Header().Rrtype != answer[i].Header().Rrtype {
+			t.Errorf("RR %d: expected %s, got %s", i, dns.TypeToString[answer[i].Header().Rrtype], cached[i])
+		}
+		if ttl := cached[i].Header().Ttl; ttl == 0 || ttl > answer[i].Header().Ttl {
+			t.Errorf("RR %d: unexpected TTL %d", i, ttl)
+		}
+	}
+
+	// a response that can't be cached leaves the old set in place
+	uncacheable, _ := dns.NewRR("www.example.org. 0 IN A 192.0.2.3")
+	cacheResponse(key, &dns.Msg{Answer: []dns.RR{uncacheable}})
+	if n := len(recursiveRecords.GetRecordsByName(key, 0)); n != len(answer) {
+		t.Errorf("expected the old set to stay cached, got %d records", n)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	resetRecursiveCache()
+
+	soa, _ := dns.NewRR("example.org. 7200 IN SOA ns.example.org. hostmaster.example.org. 1 7200 3600 1209600 300")
+	key := recursiveKey("missing.example.org.", dns.TypeA, dns.ClassINET)
+	cacheResponse(key, &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{soa}})
+
+	// a negative answer without SOA must not be cached
+	cacheResponse(recursiveKey("other.example.org.", dns.TypeA, dns.ClassINET), &dns.Msg{})
+
+	var msg dns.Msg
+	if !cachedResponse(&msg, "missing.example.org.", recursiveRecords.GetRecordsByName(key, 0)) {
+		t.Fatal("expected a cached NXDOMAIN")
+	}
+	if msg.Rcode != dns.RcodeNameError || len(msg.Answer) != 0 || len(msg.Ns) != 1 {
+		t.Fatalf("unexpected cached response %v", msg)
+	}
+	if ttl := msg.Ns[0].Header().Ttl; ttl == 0 || ttl > 300 {
+		t.Errorf("expected the SOA minimum as negative TTL, got %d", ttl)
+	}
+	if n := recursiveRecords.Count(); n != 1 {
+		t.Errorf("expected only the NXDOMAIN to be cached, got %d records", n)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	resetRecursiveCache()
+	upstream_servers = nil
+
+	key := recursiveKey("stale.example.org.", dns.TypeA, dns.ClassINET)
+	recursiveRecords.AddRecord(Record{
+		ID:   nextRecursiveID(),
+		Name: key,
+		Type: "A",
+		RR:   "stale.example.org. 0 IN A 192.0.2.1",
+		TTL:  60,
+		DOB:  time.Now().Add(-time.Hour),
+	})
+
+	msg := new(dns.Msg)
+	msg.SetEdns0(1024, true)
+	if err := recursiveAnswer(msg, "stale.example.org.", dns.TypeA, dns.ClassINET); err != nil {
+		t.Fatalf("expected a stale answer while upstreams are down, got %s", err)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != staleTTL {
+		t.Fatalf("unexpected stale answer %v", msg.Answer)
+	}
+
+	var ede bool
+	for _, option := range msg.IsEdns0().Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == ednsCodeEDE {
+			ede = reflect.DeepEqual(local.Data, []byte{0, edeStaleAnswer})
+		}
+	}
+	if !ede {
+		t.Error("expected a Stale Answer Extended DNS Error")
+	}
+}
+
+func TestShouldPrefetch(t *testing.T) {
+	defer func(fraction float64) { prefetchFraction = fraction }(prefetchFraction)
+	prefetchFraction = 0.1
+
+	hot := Record{TTL: 100, DOB: time.Now().Add(-95 * time.Second), Hits: prefetchMinHits}
+	if !shouldPrefetch([]Record{hot}) {
+		t.Error("expected a popular record close to expiry to be prefetched")
+	}
+
+	cold := hot
+	cold.Hits = prefetchMinHits - 1
+	if shouldPrefetch([]Record{cold}) {
+		t.Error("unpopular records should not be prefetched")
+	}
+
+	fresh := hot
+	fresh.DOB = time.Now()
+	if shouldPrefetch([]Record{fresh}) {
+		t.Error("records far from expiry should not be prefetched")
+	}
+}
+
+func TestLiveSets(t *testing.T) {
+	set := liveSets([]Record{
+		{ID: 3, Name: "b", TTL: 60, DOB: time.Now()},
+		{ID: 1, Name: "a", TTL: 300, DOB: time.Now().Add(-time.Minute)},
+		{ID: 2, Name: "a", TTL: 30, DOB: time.Now().Add(-time.Minute)},
+		{ID: 4, Name: "b", TTL: 60, DOB: time.Now()},
+	})
+
+	// one expired record drops the whole "a" set
+	if len(set) != 2 || set[0].ID != 3 || set[1].ID != 4 {
+		t.Errorf("expected only the b set in id order, got %v", set)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	seedZones([]Record{
+		{Name: "www", Type: recordTypeA, IP: "10.0.0.1", DomainID: 1},
+		{Name: "www", Type: recordTypeA, IP: "10.0.0.2", DomainID: 1},
+		{Name: "gone", Type: recordTypeA, IP: "10.0.0.3", DomainID: 3},
+	})
+	resetRecursiveCache()
+	key := recursiveKey("cdn.example.org.", dns.TypeA, dns.ClassINET)
+	cacheResponse(key, &dns.Msg{Answer: []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "cdn.example.org.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "edge.example.org."},
+		&dns.A{Hdr: dns.RR_Header{Name: "edge.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)},
+	}})
+	var before dns.Msg
+	cachedResponse(&before, "cdn.example.org.", recursiveRecords.GetRecordsByName(key, 0))
+	oldIDs := make(map[int]bool)
+	for _, record := range recursiveRecords.Snapshot() {
+		oldIDs[record.ID] = true
+	}
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.json")
+	if err := writeSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	resetRecordCache()
+	resetRecursiveCache()
+	n, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the record of domain 3 is dropped, it isn't in dns_domain
+	if n != 4 {
+		t.Errorf("expected 4 restored records, got %d", n)
+	}
+	if set := records.GetRecordsByName("gone", 3); len(set) != 0 {
+		t.Errorf("expected records of unknown domains to be dropped, got %v", set)
+	}
+	if set := records.GetRecordsByName("www", 1); len(set) != 2 {
+		t.Errorf("expected the www set back, got %v", set)
+	}
+
+	set := recursiveRecords.GetRecordsByName(key, 0)
+	for _, record := range set {
+		if oldIDs[record.ID] {
+			t.Errorf("expected recursive record %d to get a new id", record.ID)
+		}
+	}
+	var after dns.Msg
+	cachedResponse(&after, "cdn.example.org.", set)
+	if !reflect.DeepEqual(rrData(after.Answer), rrData(before.Answer)) {
+		t.Errorf("expected the chain back in order %q, got %q", rrData(before.Answer), rrData(after.Answer))
+	}
+
+	if records.expiry.Count() != 2 || recursiveRecords.expiry.Count() != 2 {
+		t.Errorf("expected every restored record to expire again, got %d and %d expiries",
+			records.expiry.Count(), recursiveRecords.expiry.Count())
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	cfg, err := ini.Load([]byte(`
+[cache_policy example.com]
+min_ttl = 60
+max_ttl = 3600
+
+[cache_policy volatile.example.com]
+no_cache = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(policies []cachePolicy) { cachePolicies = policies }(cachePolicies)
+	if cachePolicies, err = loadCachePolicies(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := cachePolicyFor("www.example.com.")
+	if ttl := policy.clampTTL(5); ttl != 60 {
+		t.Errorf("expected a tiny TTL to be raised to 60, got %d", ttl)
+	}
+	if ttl := policy.clampTTL(86400); ttl != 3600 {
+		t.Errorf("expected a huge TTL to be capped at 3600, got %d", ttl)
+	}
+
+	// the longest suffix wins, without inheriting keys of the shorter one
+	policy = cachePolicyFor("a.volatile.example.com.")
+	if !policy.NoCache || policy.MinTTL != 0 {
+		t.Errorf("unexpected policy %+v for a.volatile.example.com", policy)
+	}
+	if policy = cachePolicyFor("example.net."); (cachePolicy{}) != policy {
+		t.Errorf("expected no policy for example.net, got %+v", policy)
+	}
+
+	forced := Record{TTL: 60, CacheTTL: 3600, DOB: time.Now()}
+	if ttl := forced.remainingTTL(); ttl != 60 {
+		t.Errorf("a forced cache TTL should not change the served TTL, got %d", ttl)
+	}
+
+	// a cache TTL shorter than the TTL only shortens the time in cache
+	short := Record{TTL: 300, CacheTTL: 60, DOB: time.Now().Add(-30 * time.Second)}
+	if ttl := short.remainingTTL(); ttl < 269 || ttl > 270 {
+		t.Errorf("expected about 270s left of the record TTL, got %d", ttl)
+	}
+	if short.expired() {
+		t.Error("record should stay fresh until its cache TTL")
+	}
+	short.DOB = time.Now().Add(-90 * time.Second)
+	if !short.expired() {
+		t.Error("record should expire after its cache TTL")
+	}
+}
+
+func TestLookupGroup(t *testing.T) {
+	group := newLookupGroup("test")
+	coalesced := testutil.ToFloat64(coalescedLookupCounter.WithLabelValues("test"))
+	release := make(chan struct{})
+	var lookups int
+	var mu sync.Mutex
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = group.Do("www.example.org./A/IN", func() (interface{}, error) {
+				mu.Lock()
+				lookups++
+				mu.Unlock()
+				<-release
+				return "answer", nil
+			})
+		}(i)
+	}
+
+	// let every other request join the lookup before it completes
+	for i := 0; i < 1000 && testutil.ToFloat64(coalescedLookupCounter.WithLabelValues("test"))-coalesced < 9; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if lookups != 1 {
+		t.Errorf("expected concurrent misses to share 1 lookup, got %d", lookups)
+	}
+	for i := range results {
+		if results[i] != "answer" {
+			t.Errorf("request %d got %v", i, results[i])
+		}
+	}
+}
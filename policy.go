@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// cachePolicySection - prefix of the config.ini sections holding the cache
+// policy of a domain, e.g. [cache_policy example.com]
+const cachePolicySection = "cache_policy "
+
+// cachePolicy - cache overrides for a domain and every name below it
+type cachePolicy struct {
+	Suffix   string
+	MinTTL   uint32 // recursive answers with a lower TTL are raised to it
+	MaxTTL   uint32 // recursive answers with a higher TTL are lowered to it, 0 is unlimited
+	NoCache  bool   // answers are never cached
+	CacheTTL int64  // authoritative records stay cached this long whatever TTL they are served with, 0 keeps their TTL
+}
+
+// cachePolicies - configured policies, matched by longest suffix
+var cachePolicies []cachePolicy
+
+// cachePolicyFor returns the policy of the longest suffix fqdn falls under,
+// the zero policy when none does
+func cachePolicyFor(fqdn string) cachePolicy {
+	var policy cachePolicy
+	name := strings.ToLower(strings.TrimRight(fqdn, "."))
+	for _, p := range cachePolicies {
+		if name != p.Suffix && !strings.HasSuffix(name, "."+p.Suffix) {
+			continue
+		}
+		if len(p.Suffix) > len(policy.Suffix) {
+			policy = p
+		}
+	}
+	return policy
+}
+
+// recordPolicy returns the policy of an authoritative record. Recursive
+// records have theirs applied before they are cached
+func recordPolicy(record Record) cachePolicy {
+	if len(cachePolicies) == 0 || record.DomainID == 0 {
+		return cachePolicy{}
+	}
+
+	domain := domains.GetDomainByID(int(record.DomainID))
+	if (Domain{}) == domain {
+		return cachePolicy{}
+	}
+	return cachePolicyFor(recordFQDN(record.Name, domain))
+}
+
+// clampTTL bounds a recursive answer's TTL by MinTTL and MaxTTL
+func (p cachePolicy) clampTTL(ttl uint32) uint32 {
+	if ttl < p.MinTTL {
+		ttl = p.MinTTL
+	}
+	if p.MaxTTL > 0 && ttl > p.MaxTTL {
+		ttl = p.MaxTTL
+	}
+	return ttl
+}
+
+// loadCachePolicies reads the [cache_policy <domain>] sections of the config.
+// Keys are read from the section itself only, as ini would otherwise fall
+// back to [cache_policy example] for [cache_policy example.com]
+func loadCachePolicies(cfg *ini.File) ([]cachePolicy, error) {
+	var policies []cachePolicy
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), cachePolicySection) {
+			continue
+		}
+
+		policy := cachePolicy{
+			Suffix: strings.ToLower(strings.Trim(strings.TrimPrefix(section.Name(), cachePolicySection), ". ")),
+		}
+		for key, value := range section.KeysHash() {
+			var err error
+			var n uint64
+			switch key {
+			case "min_ttl":
+				n, err = strconv.ParseUint(value, 10, 32)
+				policy.MinTTL = uint32(n)
+			case "max_ttl":
+				n, err = strconv.ParseUint(value, 10, 32)
+				policy.MaxTTL = uint32(n)
+			case "cache_ttl":
+				policy.CacheTTL, err = strconv.ParseInt(value, 10, 64)
+			case "no_cache":
+				policy.NoCache, err = strconv.ParseBool(value)
+			default:
+				err = fmt.Errorf("unknown key")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("[%s] %s: %s", section.Name(), key, err.Error())
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// prefetchFraction - share of its TTL left at which a popular entry is
+// refreshed ahead of expiry, prefetch_fraction in the [cache] section of
+// config.ini. 0 disables prefetching
+var prefetchFraction float64
+
+// prefetchMinHits - cache hits an entry needs before it is prefetched,
+// prefetch_min_hits in the [cache] section of config.ini
+var prefetchMinHits int64 = 10
+
+// prefetches - entries being prefetched, so a popular name is only refreshed once
+var prefetches = struct {
+	keys map[string]bool
+	mu   sync.Mutex
+}{keys: make(map[string]bool)}
+
+// shouldPrefetch reports whether the set is popular and within
+// prefetchFraction of its TTL. Expired sets are left to serve-stale
+func shouldPrefetch(set []Record) bool {
+	if prefetchFraction <= 0 || len(set) == 0 {
+		return false
+	}
+
+	var hits int64
+	var near bool
+	for i := range set {
+		if set[i].TTL <= 0 || set[i].expired() {
+			return false
+		}
+		if set[i].Hits > hits {
+			hits = set[i].Hits
+		}
+		left := time.Duration(set[i].cacheTTL())*time.Second - time.Since(set[i].DOB)
+		if left.Seconds() <= prefetchFraction*float64(set[i].cacheTTL()) {
+			near = true
+		}
+	}
+	return near && hits >= prefetchMinHits
+}
+
+// prefetch runs refresh in the background for the entry under key, unless a
+// prefetch of it is already running
+func prefetch(key string, queryType string, refresh func() error) {
+	prefetches.mu.Lock()
+	if prefetches.keys[key] {
+		prefetches.mu.Unlock()
+		return
+	}
+	prefetches.keys[key] = true
+	prefetches.mu.Unlock()
+
+	prefetchCounter.WithLabelValues(queryType).Inc()
+	go func() {
+		defer func() {
+			prefetches.mu.Lock()
+			delete(prefetches.keys, key)
+			prefetches.mu.Unlock()
+		}()
+
+		if err := refresh(); err != nil {
+			logger("cache").Warning(fmt.Sprintf("Failed to prefetch %s: %s", key, err.Error()))
+		}
+	}()
+}
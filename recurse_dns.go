@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -9,7 +12,19 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func recurseResolve(fqdn string, recordType uint16) []dns.RR {
+// errUpstreamFailed - returned by recurseResolve when no upstream server answered
+var errUpstreamFailed = errors.New("all upstream servers failed")
+
+// usableRcode reports whether an upstream response answers the question,
+// anything but NOERROR and NXDOMAIN is a failure of that upstream (RFC 8767)
+func usableRcode(rcode int) bool {
+	return rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError
+}
+
+// recurseResolve sends the question to the upstream servers in order and
+// returns the first response that answers it, upstreams failing with
+// SERVFAIL/REFUSED are skipped like unreachable ones
+func recurseResolve(fqdn string, recordType uint16) (*dns.Msg, error) {
 	timeStart := time.Now()
 
 	if string(fqdn[len(fqdn)-1]) != "." {
@@ -21,8 +36,8 @@ func recurseResolve(fqdn string, recordType uint16) []dns.RR {
 	msg.RecursionDesired = true
 	msg.Question = make([]dns.Question, 1)
 
-	msg.Question[0] = dns.Question{fqdn, recordType, dns.ClassINET}
-	var answer []dns.RR
+	msg.Question[0] = dns.Question{Name: fqdn, Qtype: recordType, Qclass: dns.ClassINET}
+	var answer *dns.Msg
 
 	var upstreamWinner string
 
@@ -38,8 +53,13 @@ func recurseResolve(fqdn string, recordType uint16) []dns.RR {
 			logger("recurse_dns").Errorf("Retrying lookup due to failed upstream lookup on server %s", sockPath)
 			continue
 		}
-		answer = in.Answer
+		if !usableRcode(in.Rcode) {
+			logger("recurse_dns").Errorf("Retrying lookup due to %s from upstream server %s", dns.RcodeToString[in.Rcode], sockPath)
+			continue
+		}
+		answer = in
 		upstreamWinner = upstream_servers[i]
+		break
 	}
 
 	timeStop := time.Now()
@@ -50,8 +70,11 @@ func recurseResolve(fqdn string, recordType uint16) []dns.RR {
 		"resolver":   upstreamWinner,
 		"query_type": dns.TypeToString[recordType],
 	}).Info(fmt.Sprintf("Query: %s", fqdn))
-	recordQueryCounter.WithLabelValues("recurse", dns.TypeToString[recordType]).Inc()
-	return answer
+
+	if answer == nil {
+		return nil, errUpstreamFailed
+	}
+	return answer, nil
 
 	//	c := new(dns.Client)
 	//	c.Timeout = time.Duration(2 * time.Second)
@@ -76,3 +99,234 @@ func recurseResolve(fqdn string, recordType uint16) []dns.RR {
 
 	//return in.Answer
 }
+
+// recursiveKey returns the key the recursive cache keeps the answer to a
+// question under, stored as the Name of its records. Types and classes the
+// dns package has no name for are keyed as TYPEnnn/CLASSnnn (RFC 3597)
+func recursiveKey(fqdn string, qtype uint16, qclass uint16) string {
+	return fmt.Sprintf("%s/%s/%s", strings.ToLower(dns.Fqdn(fqdn)), dns.Type(qtype).String(), dns.Class(qclass).String())
+}
+
+// recursiveDomains returns the names with answers in the recursive cache,
+// what the recursive domain cache reported before answers were cached per
+// question. Sorted, so the debug output is stable
+func recursiveDomains() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, key := range recursiveRecords.Owners() {
+		name := strings.TrimSuffix(key[:strings.Index(key, "/")], ".")
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Negative answers kept in the recursive cache (RFC 2308), set as Negative on
+// the record carrying the SOA of the answer
+const (
+	negativeNXDomain = "NXDOMAIN"
+	negativeNoData   = "NODATA"
+)
+
+// negativeMaxTTL - longest time in seconds a negative answer is cached,
+// negative_max_ttl in the [cache] section of config.ini
+var negativeMaxTTL int64 = 3600
+
+// cachedResponse fills msg from the records of a recursive cache entry, with
+// the TTLs remaining and the answer in the order upstream sent it. Negative
+// answers get their rcode back and the SOA in the authority section. Returns
+// false on a miss
+func cachedResponse(msg *dns.Msg, fqdn string, set []Record) bool {
+	if len(set) == 0 {
+		return false
+	}
+
+	var answer, authority []dns.RR
+	var negative string
+	for _, device := range set {
+		rr, err := dns.NewRR(device.RR)
+		if err != nil || rr == nil {
+			logger("recurse_dns").Warning(fmt.Sprintf("Dropping unreadable cached answer for %s", device.Name))
+			return false
+		}
+		rr.Header().Ttl = device.remainingTTL()
+		// echo the case the question was asked in
+		if strings.EqualFold(rr.Header().Name, fqdn) {
+			rr.Header().Name = fqdn
+		}
+
+		if device.Negative != "" {
+			negative = device.Negative
+			authority = append(authority, rr)
+		} else {
+			answer = append(answer, rr)
+		}
+	}
+
+	if negative != "" {
+		negativeCacheHitCounter.WithLabelValues(strings.ToLower(negative)).Inc()
+	}
+	if negative == negativeNXDomain {
+		msg.Rcode = dns.RcodeNameError
+	}
+	msg.Answer = append(msg.Answer, orderRRsets(answer)...)
+	msg.Ns = append(msg.Ns, authority...)
+	return true
+}
+
+// cacheResponse adds an upstream response to the recursive cache under key,
+// in place of the old set. Answers are cached as a whole, CNAME chain
+// included, and must not be cached when they carry a TTL of 0. NXDOMAIN and
+// NODATA are cached for the negative TTL of their SOA (RFC 2308 section 5),
+// bounded by negativeMaxTTL, and not at all without one. The old set is only
+// replaced once the response is known to be cached, and in one step so a
+// popular name being prefetched never misses
+func cacheResponse(key string, in *dns.Msg) {
+	var negative string
+	switch {
+	case in.Rcode == dns.RcodeNameError:
+		negative = negativeNXDomain
+	case in.Rcode != dns.RcodeSuccess:
+		return
+	case len(in.Answer) == 0:
+		negative = negativeNoData
+	}
+
+	var set []Record
+	for _, rr := range in.Answer {
+		if rr.Header().Ttl == 0 {
+			return
+		}
+		set = append(set, cacheRecord(key, rr, int64(rr.Header().Ttl)))
+	}
+
+	if negative != "" {
+		var soa *dns.SOA
+		for _, rr := range in.Ns {
+			if rr, ok := rr.(*dns.SOA); ok {
+				soa = rr
+			}
+		}
+		if soa == nil {
+			return
+		}
+
+		ttl := int64(soa.Hdr.Ttl)
+		if int64(soa.Minttl) < ttl {
+			ttl = int64(soa.Minttl)
+		}
+		if negativeMaxTTL < ttl {
+			ttl = negativeMaxTTL
+		}
+		if ttl <= 0 {
+			return
+		}
+
+		record := cacheRecord(key, soa, ttl)
+		record.Negative = negative
+		set = append(set, record)
+	}
+
+	// ids are handed out in answer order, which keeps the chain in order when
+	// it is read back
+	replaceCachedSet(0, key, set, recursiveRecords)
+}
+
+// cacheRecord returns the recursive cache record holding rr under key. The
+// TTL lives in the record, keeping it out of the RR lets Contains spot an
+// answer that is already cached
+func cacheRecord(key string, rr dns.RR, ttl int64) Record {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	return Record{
+		ID:      nextRecursiveID(),
+		Name:    key,
+		Type:    dns.TypeToString[rr.Header().Rrtype],
+		RR:      rr.String(),
+		TTL:     ttl,
+		Created: time.Now(),
+	}
+}
+
+// recursiveAnswer fills msg with the answer for a name outside of our zones,
+// served from the recursive cache or resolved upstream. The upstream rcode
+// and authority section are passed through, answers and NXDOMAIN/NODATA
+// responses are cached. Expired entries are served stale when every upstream
+// fails or answers SERVFAIL/REFUSED and refreshed in the background, popular
+// ones are prefetched
+func recursiveAnswer(msg *dns.Msg, fqdn string, qtype uint16, qclass uint16) error {
+	logger("recurse_dns").Debug(fmt.Sprintf("Starting recursive lookup: %s", fqdn))
+
+	key := recursiveKey(fqdn, qtype, qclass)
+	set := recursiveRecords.GetRecordsByName(key, 0)
+	if (!staleSet(set) || refreshing(key)) && cachedResponse(msg, fqdn, set) {
+		logger("recurse_dns").Debug("Returning cached recursive answer")
+		if staleSet(set) {
+			markStale(msg)
+		} else if shouldPrefetch(set) {
+			prefetch(key, "recurse", func() error {
+				_, err := refreshRecursive(fqdn, qtype, key)
+				return err
+			})
+		}
+		return nil
+	}
+	logger("recurse_dns").Debug("Recursive answer not found in cache, performing lookup")
+
+	in, err := refreshRecursive(fqdn, qtype, key)
+	if err != nil {
+		if cachedResponse(msg, fqdn, set) {
+			logger("recurse_dns").Warning(fmt.Sprintf("Serving stale answer for %s: %s", key, err.Error()))
+			markStale(msg)
+			refreshInBackground(key, func() error {
+				_, err := refreshRecursive(fqdn, qtype, key)
+				return err
+			})
+			return nil
+		}
+		msg.Rcode = dns.RcodeServerFailure
+		return err
+	}
+	msg.Rcode = in.Rcode
+	msg.Answer = append(msg.Answer, in.Answer...)
+	msg.Ns = append(msg.Ns, in.Ns...)
+
+	return nil
+}
+
+// refreshRecursive resolves the question upstream and caches the response
+// under key in place of the cached set. Concurrent refreshes of the same
+// question share a single upstream query, each getting its own copy of the
+// response
+func refreshRecursive(fqdn string, qtype uint16, key string) (*dns.Msg, error) {
+	in, err := upstreamLookups.Do(key, func() (interface{}, error) {
+		return cacheUpstream(fqdn, qtype, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return in.(*dns.Msg).Copy(), nil
+}
+
+// cacheUpstream performs the upstream query of refreshRecursive. Answer TTLs
+// are clamped by the cache policy of the name, which may also keep it out of
+// the cache
+func cacheUpstream(fqdn string, qtype uint16, key string) (*dns.Msg, error) {
+	in, err := recurseResolve(fqdn, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := cachePolicyFor(fqdn)
+	for _, rr := range in.Answer {
+		rr.Header().Ttl = policy.clampTTL(rr.Header().Ttl)
+	}
+	if !policy.NoCache {
+		cacheResponse(key, in)
+	}
+
+	return in, nil
+}
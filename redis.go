@@ -11,6 +11,10 @@ import (
 
 // CacheControlMessage -- struct for storing/parsing redis cache control messages
 //  					  from the api server
+//
+// Object holds the JSON encoded Record or Domain, e.g. for an SRV record:
+//
+//	{"ID": 12, "Name": "_sip._tcp", "Type": "SRV", "Target": "sip.example.com", "Priority": 10, "Weight": 5, "Port": 5060, "TTL": 300, "DomainID": 1}
 type CacheControlMessage struct {
 	Action string
 	Type   string
@@ -22,12 +26,28 @@ func cacheMessageHandler(msg CacheControlMessage) error {
 	case "record":
 		var record Record
 		json.Unmarshal([]byte(msg.Object), &record)
+		// apex records are cached as @, whichever name the api sent them with
+		if record.Name == "" {
+			record.Name = apexName
+		}
 
 		//Record cache manage routes
 		switch strings.ToLower(msg.Action) {
 		case "create":
-			addRecordToCache(record, records, recordCacheChannel, recordCachePurgeChannel)
+			zoneNames.Add(record.DomainID, record.Name)
+			// only extend names that are already cached, otherwise load the whole
+			// set from the database so a name is never cached with part of its records
+			if len(records.GetRecordsByName(record.Name, record.DomainID)) > 0 {
+				addRecordToCache(record, records, recordCacheChannel)
+				indexRecord(record, domains.GetDomainByID(int(record.DomainID)))
+			} else {
+				if _, err := getCachedRecords(record.Name, domains.GetDomainByID(int(record.DomainID))); err != nil {
+					logger("redis").Error(err.Error())
+				}
+			}
 		case "purge":
+			// the PTR is added back when the record is next loaded from the database
+			unindexRecord(record, domains.GetDomainByID(int(record.DomainID)))
 			recordCachePurgeChannel <- record
 		}
 	case "domain":
@@ -39,7 +59,12 @@ func cacheMessageHandler(msg CacheControlMessage) error {
 		case "create":
 			//Create the domain object and then throw it into cache
 		case "purge":
-			//Purge the domain object from cache
+			// drop every cached record of the domain, they are reloaded on demand
+			purged := records.Purge(func(record Record) bool {
+				return record.DomainID == domain.ID
+			})
+			zoneNames.Forget(domain.ID)
+			logger("redis").Debug(fmt.Sprintf("Purged %d cached records of domain %s", purged, domain.Name))
 		}
 	}
 	return nil
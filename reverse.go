@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Pointer -- struct for storing the PTR target of a reverse name
+type Pointer struct {
+	Target string
+	TTL    int64
+}
+
+// ReverseMap - reverse index of in-addr.arpa/ip6.arpa names built from the
+// address records in dns_record
+type ReverseMap struct {
+	Pointers map[string][]Pointer
+	targets  map[string][]string // reverse names by lowercased PTR target
+	below    map[string]int      // indexed names below each reverse name
+	mu       *sync.Mutex
+}
+
+func (p *ReverseMap) GetPointers(name string) []Pointer {
+	var pointers []Pointer
+	p.mu.Lock()
+	pointers = append(pointers, p.Pointers[strings.ToLower(name)]...)
+	p.mu.Unlock()
+
+	return pointers
+}
+
+func (p *ReverseMap) AddPointer(name string, pointer Pointer) {
+	name = strings.ToLower(name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.add(name, pointer)
+}
+
+func (p *ReverseMap) DeletePointer(name string, target string) {
+	name = strings.ToLower(name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.remove(name, target)
+}
+
+// ReplaceTarget swaps every PTR pointing at target for pointers, keyed by
+// reverse name, so addresses a name no longer has stop resolving to it
+func (p *ReverseMap) ReplaceTarget(target string, pointers map[string]Pointer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, name := range append([]string(nil), p.targets[strings.ToLower(target)]...) {
+		p.remove(name, target)
+	}
+	for name, pointer := range pointers {
+		p.add(strings.ToLower(name), pointer)
+	}
+}
+
+// add indexes pointer under the lowercased name, p.mu must be held
+func (p *ReverseMap) add(name string, pointer Pointer) {
+	for i := range p.Pointers[name] {
+		if strings.EqualFold(p.Pointers[name][i].Target, pointer.Target) {
+			p.Pointers[name][i] = pointer
+			return
+		}
+	}
+	if len(p.Pointers[name]) == 0 {
+		for _, ancestor := range ancestors(name) {
+			p.below[ancestor]++
+		}
+	}
+	p.Pointers[name] = append(p.Pointers[name], pointer)
+
+	target := strings.ToLower(pointer.Target)
+	p.targets[target] = append(p.targets[target], name)
+}
+
+// remove drops the pointer from the lowercased name to target, p.mu must be held
+func (p *ReverseMap) remove(name string, target string) {
+	pointers := p.Pointers[name][:0]
+	for _, pointer := range p.Pointers[name] {
+		if !strings.EqualFold(pointer.Target, target) {
+			pointers = append(pointers, pointer)
+		}
+	}
+	if len(pointers) == 0 {
+		if _, ok := p.Pointers[name]; ok {
+			for _, ancestor := range ancestors(name) {
+				if p.below[ancestor]--; p.below[ancestor] == 0 {
+					delete(p.below, ancestor)
+				}
+			}
+		}
+		delete(p.Pointers, name)
+	} else {
+		p.Pointers[name] = pointers
+	}
+
+	target = strings.ToLower(target)
+	names := p.targets[target][:0]
+	for _, n := range p.targets[target] {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		delete(p.targets, target)
+	} else {
+		p.targets[target] = names
+	}
+}
+
+// HasDescendant reports whether any name below name is indexed, such empty
+// non-terminals must answer NODATA rather than NXDOMAIN
+func (p *ReverseMap) HasDescendant(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.below[strings.ToLower(name)] > 0
+}
+
+// ancestors returns the names above a reverse name, up to the root label
+func ancestors(name string) []string {
+	var names []string
+	for i, c := range name {
+		if c == '.' && i < len(name)-1 {
+			names = append(names, name[i+1:])
+		}
+	}
+	return names
+}
+
+func (p *ReverseMap) Count() int {
+	var i int
+	p.mu.Lock()
+	i = len(p.Pointers)
+	p.mu.Unlock()
+	return i
+}
+
+// getReverseZone returns the configured reverse zone fqdn belongs to, or an
+// empty string when the address space isn't ours
+func getReverseZone(fqdn string) string {
+	fqdn = strings.ToLower(dns.Fqdn(fqdn))
+
+	var zone string
+	for _, z := range reverseZones {
+		if (fqdn == z || strings.HasSuffix(fqdn, "."+z)) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+// recordFQDN returns the fully qualified owner name of a record in domain
+func recordFQDN(name string, domain Domain) string {
+	if name == apexName || name == "" {
+		return dns.Fqdn(domain.Name)
+	}
+	return dns.Fqdn(name + "." + domain.Name)
+}
+
+// wildcardName reports whether an owner name has a * label, such records only
+// synthesize answers and are not a name PTRs can point at
+func wildcardName(name string) bool {
+	for _, label := range strings.Split(name, ".") {
+		if label == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// recordPointers returns the PTRs, keyed by reverse name, for the record's
+// addresses that fall in one of our reverse zones
+func recordPointers(record Record, domain Domain) map[string]Pointer {
+	pointers := make(map[string]Pointer)
+	if !record.isAddress() || (Domain{}) == domain || wildcardName(record.Name) {
+		return pointers
+	}
+
+	for _, ip := range []string{record.IP, record.IPv6} {
+		if ip == "" {
+			continue
+		}
+		name, err := dns.ReverseAddr(ip)
+		if err != nil || getReverseZone(name) == "" {
+			continue
+		}
+		pointers[name] = Pointer{Target: recordFQDN(record.Name, domain), TTL: record.TTL}
+	}
+	return pointers
+}
+
+// indexRecord adds PTRs for the record's addresses that fall in one of our
+// reverse zones
+func indexRecord(record Record, domain Domain) {
+	for name, pointer := range recordPointers(record, domain) {
+		reverseRecords.AddPointer(name, pointer)
+	}
+}
+
+// reindexName rebuilds the PTRs pointing at name in domain from the set just
+// loaded for it, dropping those of addresses it no longer has
+func reindexName(name string, domain Domain, set []Record) {
+	if (Domain{}) == domain {
+		return
+	}
+
+	pointers := make(map[string]Pointer)
+	for _, record := range set {
+		for reverse, pointer := range recordPointers(record, domain) {
+			pointers[reverse] = pointer
+		}
+	}
+	reverseRecords.ReplaceTarget(recordFQDN(name, domain), pointers)
+}
+
+// unindexRecord removes the PTRs added by indexRecord
+func unindexRecord(record Record, domain Domain) {
+	if !record.isAddress() || (Domain{}) == domain {
+		return
+	}
+
+	for _, ip := range []string{record.IP, record.IPv6} {
+		if name, err := dns.ReverseAddr(ip); ip != "" && err == nil {
+			reverseRecords.DeletePointer(name, recordFQDN(record.Name, domain))
+		}
+	}
+}
+
+// reverseAnswer fills msg with the answer for a query in one of our reverse zones
+func reverseAnswer(msg *dns.Msg, fqdn string, qtype uint16, zone string) {
+	// reverse zones have no dns_domain row, they are served with default SOA values
+	domain := Domain{Name: zone}.withSOADefaults()
+
+	if strings.EqualFold(dns.Fqdn(fqdn), zone) && qtype == dns.TypeSOA {
+		msg.Answer = append(msg.Answer, domain.soaRR())
+		return
+	}
+
+	pointers := reverseRecords.GetPointers(dns.Fqdn(fqdn))
+	if qtype == dns.TypePTR || qtype == dns.TypeANY {
+		for _, pointer := range pointers {
+			msg.Answer = append(msg.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: uint32(pointer.TTL)},
+				Ptr: pointer.Target,
+			})
+		}
+	}
+
+	if len(msg.Answer) == 0 {
+		if len(pointers) == 0 && !strings.EqualFold(dns.Fqdn(fqdn), zone) && !reverseRecords.HasDescendant(dns.Fqdn(fqdn)) {
+			logger("reverse_dns").Debug(fmt.Sprintf("No PTR found for %s", fqdn))
+			msg.Rcode = dns.RcodeNameError
+		}
+		msg.Ns = append(msg.Ns, domain.negativeSOA())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// RRset orderings, selected with rrset_order in the [dns] section of config.ini
+const (
+	rrsetOrderRoundRobin = "round-robin" // rotate the set by one on every answer
+	rrsetOrderRandom     = "random"      // shuffle the set on every answer
+	rrsetOrderFixed      = "fixed"       // always answer in database (id) order
+)
+
+var rrsetOrder = rrsetOrderRoundRobin
+
+// rrsetRotation - round-robin positions, names are hashed into a fixed number
+// of counters so recursive lookups can't grow this without bound
+var rrsetRotation = struct {
+	counters [256]int
+	mu       sync.Mutex
+}{}
+
+// orderRRset orders the RRs of a single RRset according to rrsetOrder, rrs
+// are expected in their fixed order
+func orderRRset(rrs []dns.RR) []dns.RR {
+	if len(rrs) < 2 {
+		return rrs
+	}
+
+	switch rrsetOrder {
+	case rrsetOrderRandom:
+		rand.Shuffle(len(rrs), func(i, j int) {
+			rrs[i], rrs[j] = rrs[j], rrs[i]
+		})
+	case rrsetOrderRoundRobin:
+		h := fnv.New32a()
+		h.Write([]byte(strings.ToLower(rrs[0].Header().Name) + dns.TypeToString[rrs[0].Header().Rrtype]))
+		bucket := h.Sum32() % uint32(len(rrsetRotation.counters))
+
+		rrsetRotation.mu.Lock()
+		n := rrsetRotation.counters[bucket] % len(rrs)
+		rrsetRotation.counters[bucket] = n + 1
+		rrsetRotation.mu.Unlock()
+
+		rotated := make([]dns.RR, 0, len(rrs))
+		rotated = append(rotated, rrs[n:]...)
+		rrs = append(rotated, rrs[:n]...)
+	}
+	return rrs
+}
+
+// orderRRsets orders every RRset of an answer made of consecutive RRsets, such
+// as a CNAME chain followed by the RRset it ends in
+func orderRRsets(rrs []dns.RR) []dns.RR {
+	var ordered []dns.RR
+	for start := 0; start < len(rrs); {
+		end := start + 1
+		for end < len(rrs) && rrs[end].Header().Rrtype == rrs[start].Header().Rrtype &&
+			strings.EqualFold(rrs[end].Header().Name, rrs[start].Header().Name) {
+			end++
+		}
+		ordered = append(ordered, orderRRset(normalizeTTL(rrs[start:end]))...)
+		start = end
+	}
+	return ordered
+}
+
+// normalizeTTL gives every RR of an RRset the lowest TTL among them, an RRset
+// must not be served with differing TTLs (RFC 2181 section 5.2)
+func normalizeTTL(rrs []dns.RR) []dns.RR {
+	if len(rrs) == 0 {
+		return rrs
+	}
+
+	ttl := rrs[0].Header().Ttl
+	for i := range rrs {
+		if rrs[i].Header().Ttl < ttl {
+			ttl = rrs[i].Header().Ttl
+		}
+	}
+	for i := range rrs {
+		rrs[i].Header().Ttl = ttl
+	}
+	return rrs
+}
+
+// minimalRRset keeps only the first RRset of an answer to an ANY query, as
+// allowed by RFC 8482 section 4.1
+func minimalRRset(rrs []dns.RR) []dns.RR {
+	if len(rrs) == 0 {
+		return rrs
+	}
+
+	var minimal []dns.RR
+	first := rrs[0].Header()
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == first.Rrtype && strings.EqualFold(rr.Header().Name, first.Name) {
+			minimal = append(minimal, rr)
+		}
+	}
+	return minimal
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// cacheSnapshot - contents of the snapshot file, records keep their DOB and
+// TTL so their remaining TTL carries over a restart
+type cacheSnapshot struct {
+	Written   time.Time
+	Records   []Record
+	Recursive []Record
+}
+
+// Snapshot returns a copy of every cached record
+func (r *RecordMap) Snapshot() []Record {
+	r.mu.Lock()
+	set := make([]Record, 0, len(r.Records))
+	for i := range r.Records {
+		set = append(set, r.Records[i])
+	}
+	r.mu.Unlock()
+
+	return set
+}
+
+// restore adds a record read back from a snapshot, it expires when its
+// original TTL runs out
+func (r *RecordMap) restore(record Record) {
+	r.AddRecord(record)
+	r.expiry.Schedule(record, time.Until(record.DOB.Add(time.Duration(record.cacheTTL())*time.Second))+staleWindow)
+}
+
+// writeSnapshot writes both caches to path, through a temporary file so a
+// crash never leaves a truncated snapshot behind
+func writeSnapshot(path string) error {
+	data, err := json.Marshal(cacheSnapshot{
+		Written:   time.Now(),
+		Records:   records.Snapshot(),
+		Recursive: recursiveRecords.Snapshot(),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadSnapshot restores the sets of a snapshot that are still within their
+// TTL and returns how many records were restored. Records of zones that are
+// gone are dropped, a missing snapshot is not an error
+func loadSnapshot(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, fmt.Errorf("reading snapshot %s: %s", path, err.Error())
+	}
+
+	var n int
+	for _, record := range liveSets(snapshot.Records) {
+		domain := domains.GetDomainByID(int(record.DomainID))
+		if (Domain{}) == domain {
+			continue
+		}
+		indexRecord(record, domain)
+		records.restore(record)
+		n++
+	}
+	for _, record := range liveSets(snapshot.Recursive) {
+		// recursive ids are handed out again, they only live as long as the process
+		record.ID = nextRecursiveID()
+		recursiveRecords.restore(record)
+		n++
+	}
+
+	return n, nil
+}
+
+// liveSets returns the records of the sets without an expired record, in id
+// order. A set is only ever cached whole, so one expired record drops its set
+func liveSets(set []Record) []Record {
+	owner := func(record Record) string {
+		return fmt.Sprintf("%d/%s", record.DomainID, record.Name)
+	}
+
+	expired := make(map[string]bool)
+	for i := range set {
+		if set[i].expired() {
+			expired[owner(set[i])] = true
+		}
+	}
+
+	sort.Slice(set, func(i, j int) bool {
+		return set[i].ID < set[j].ID
+	})
+
+	var live []Record
+	for i := range set {
+		if !expired[owner(set[i])] {
+			live = append(live, set[i])
+		}
+	}
+	return live
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// staleWindow - how long records are kept past their TTL to answer from when
+// MySQL or every upstream is unreachable (RFC 8767), stale_window in the
+// [cache] section of config.ini. 0 expires records at their TTL
+var staleWindow time.Duration
+
+// staleTTL - TTL of stale answers, as recommended by RFC 8767 section 4
+const staleTTL = 30
+
+// staleRetryInterval - delay between the background refreshes of a stale entry
+var staleRetryInterval = 30 * time.Second
+
+// Extended DNS Errors (RFC 8914), not known to the dns package yet
+const (
+	ednsCodeEDE    = 15
+	edeStaleAnswer = 3
+)
+
+// staleRefreshes - stale entries being refreshed in the background, queries
+// for them are answered stale right away instead of waiting on the backend
+var staleRefreshes = struct {
+	keys map[string]bool
+	mu   sync.Mutex
+}{keys: make(map[string]bool)}
+
+// expired reports whether the record outlived its TTL and is only kept to be
+// served stale
+func (r Record) expired() bool {
+	return r.TTL > 0 && !r.DOB.IsZero() && time.Since(r.DOB) >= time.Duration(r.cacheTTL())*time.Second
+}
+
+// staleSet reports whether any record of the set expired, a set is refreshed
+// as a whole
+func staleSet(set []Record) bool {
+	for i := range set {
+		if set[i].expired() {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshing reports whether the entry under key is being refreshed in the
+// background
+func refreshing(key string) bool {
+	staleRefreshes.mu.Lock()
+	defer staleRefreshes.mu.Unlock()
+	return staleRefreshes.keys[key]
+}
+
+// refreshInBackground retries refresh every staleRetryInterval until it
+// succeeds or the stale entry under key drops out of the cache. Only one
+// refresh runs per key
+func refreshInBackground(key string, refresh func() error) {
+	staleRefreshes.mu.Lock()
+	if staleRefreshes.keys[key] {
+		staleRefreshes.mu.Unlock()
+		return
+	}
+	staleRefreshes.keys[key] = true
+	staleRefreshes.mu.Unlock()
+
+	go func() {
+		defer func() {
+			staleRefreshes.mu.Lock()
+			delete(staleRefreshes.keys, key)
+			staleRefreshes.mu.Unlock()
+		}()
+
+		for giveUp := time.Now().Add(staleWindow); time.Now().Before(giveUp); {
+			time.Sleep(staleRetryInterval)
+			err := refresh()
+			if err == nil {
+				logger("cache").Debug(fmt.Sprintf("Refreshed stale entry %s", key))
+				return
+			}
+			logger("cache").Warning(fmt.Sprintf("Failed to refresh stale entry %s: %s", key, err.Error()))
+		}
+	}()
+}
+
+// markStale flags msg as answered from stale data with an Extended DNS Error,
+// carried in the OPT record of the response
+func markStale(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, option := range opt.Option {
+		if option.Option() == ednsCodeEDE {
+			return
+		}
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsCodeEDE, Data: []byte{0, edeStaleAnswer}})
+}
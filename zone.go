@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SOA values used for dns_domain rows that don't set their own
+const (
+	defaultSOASerial  = 1
+	defaultSOARefresh = 3600
+	defaultSOARetry   = 600
+	defaultSOAExpire  = 604800
+	defaultSOAMinimum = 300
+	defaultSOATTL     = 3600
+)
+
+// apexName - record name of the zone apex in dns_record, rows predating it
+// use an empty name
+const apexName = "@"
+
+// findZone returns the owner name relative to the zone fqdn belongs to along
+// with the zone, e.g. a.b.example.com resolves to record a.b in example.com.
+// The Domain is empty when fqdn isn't in one of our zones
+func findZone(fqdn string) (string, Domain) {
+	domain := domains.GetDomainBySuffix(fqdn)
+	if (Domain{}) == domain {
+		return "", domain
+	}
+	return relativeName(fqdn, domain.Name), domain
+}
+
+// relativeName returns fqdn relative to zone, the apex is apexName
+func relativeName(fqdn string, zone string) string {
+	name := strings.ToLower(strings.TrimRight(fqdn, "."))
+	zone = strings.ToLower(strings.TrimRight(zone, "."))
+	if name == zone {
+		return apexName
+	}
+	return strings.TrimSuffix(name, "."+zone)
+}
+
+// withSOADefaults fills in the SOA fields missing from the database
+func (d Domain) withSOADefaults() Domain {
+	if d.MName == "" {
+		if ns := d.nameserverNames(); len(ns) > 0 {
+			d.MName = ns[0]
+		} else {
+			d.MName = "ns1." + d.Name
+		}
+	}
+	if d.RName == "" {
+		d.RName = "hostmaster." + d.Name
+	}
+	if d.Serial == 0 {
+		d.Serial = defaultSOASerial
+	}
+	if d.Refresh == 0 {
+		d.Refresh = defaultSOARefresh
+	}
+	if d.Retry == 0 {
+		d.Retry = defaultSOARetry
+	}
+	if d.Expire == 0 {
+		d.Expire = defaultSOAExpire
+	}
+	if d.Minimum == 0 {
+		d.Minimum = defaultSOAMinimum
+	}
+	if d.TTL == 0 {
+		d.TTL = defaultSOATTL
+	}
+	return d
+}
+
+// nameserverNames returns the fully qualified names of the zone's NS set
+func (d Domain) nameserverNames() []string {
+	var names []string
+	for _, ns := range strings.Split(d.Nameservers, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			names = append(names, dns.Fqdn(ns))
+		}
+	}
+	return names
+}
+
+func (d Domain) soaRR() *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(d.Name), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(d.TTL)},
+		Ns:      dns.Fqdn(d.MName),
+		Mbox:    dns.Fqdn(d.RName),
+		Serial:  d.Serial,
+		Refresh: d.Refresh,
+		Retry:   d.Retry,
+		Expire:  d.Expire,
+		Minttl:  d.Minimum,
+	}
+}
+
+func (d Domain) nsRRs() []dns.RR {
+	var rrs []dns.RR
+	for _, ns := range d.nameserverNames() {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: dns.Fqdn(d.Name), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(d.TTL)},
+			Ns:  ns,
+		})
+	}
+	return rrs
+}
+
+// negativeSOA returns the SOA for the authority section of NXDOMAIN/NODATA
+// answers, its TTL is the negative caching TTL from RFC 2308 - the lower of
+// the SOA TTL and SOA minimum
+func (d Domain) negativeSOA() *dns.SOA {
+	soa := d.soaRR()
+	if d.Minimum < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = d.Minimum
+	}
+	return soa
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errZoneNotIndexed - returned by ZoneNameMap.Lookup for a zone forgotten
+// while its index was loading
+var errZoneNotIndexed = errors.New("zone names not indexed")
+
+// zoneRetryInterval - how long the old index of a zone is used before a
+// failed reload is retried
+const zoneRetryInterval = 30 * time.Second
+
+// zoneIndex - the owner names of one zone's records and the names with
+// records below them (empty non-terminals among them), lowercased
+type zoneIndex struct {
+	names  map[string]bool
+	below  map[string]bool
+	loaded time.Time
+}
+
+// ZoneNameMap - per zone index of the names in dns_record, loaded in a single
+// query so names that don't exist are answered without asking MySQL. Like
+// our NXDOMAINs in other resolvers, an index is trusted for the negative TTL
+// of its zone and then reloaded
+type ZoneNameMap struct {
+	Zones map[int64]*zoneIndex
+	mu    *sync.Mutex
+}
+
+func newZoneIndex(names []string) *zoneIndex {
+	index := &zoneIndex{
+		names:  make(map[string]bool),
+		below:  make(map[string]bool),
+		loaded: time.Now(),
+	}
+	for _, name := range names {
+		index.add(name)
+	}
+	return index
+}
+
+// add indexes name and marks its ancestors below the apex as having records
+// below them
+func (z *zoneIndex) add(name string) {
+	// apex records are stored as @, rows predating that use an empty name
+	if name == "" {
+		name = apexName
+	}
+	name = strings.ToLower(name)
+	z.names[name] = true
+	if name == apexName {
+		return
+	}
+
+	labels := strings.Split(name, ".")
+	for i := 1; i < len(labels); i++ {
+		z.below[strings.Join(labels[i:], ".")] = true
+	}
+}
+
+// Store replaces the index of a zone with names
+func (z *ZoneNameMap) Store(domainID int64, names []string) {
+	index := newZoneIndex(names)
+	z.mu.Lock()
+	z.Zones[domainID] = index
+	z.mu.Unlock()
+}
+
+// backoff keeps answering from the index of a zone that failed to reload
+// for zoneRetryInterval (at most ttl) before trying MySQL again, so queries
+// don't each wait out dbTimeout while it is down
+func (z *ZoneNameMap) backoff(domainID int64, ttl time.Duration) {
+	retry := zoneRetryInterval
+	if retry > ttl {
+		retry = ttl
+	}
+
+	z.mu.Lock()
+	if index, ok := z.Zones[domainID]; ok {
+		index.loaded = time.Now().Add(retry - ttl)
+	}
+	z.mu.Unlock()
+}
+
+// Add indexes a name created in a zone, zones that aren't indexed yet pick it
+// up when they are loaded
+func (z *ZoneNameMap) Add(domainID int64, name string) {
+	z.mu.Lock()
+	if index, ok := z.Zones[domainID]; ok {
+		index.add(name)
+	}
+	z.mu.Unlock()
+}
+
+// Forget drops the index of a zone, it is reloaded on demand
+func (z *ZoneNameMap) Forget(domainID int64) {
+	z.mu.Lock()
+	delete(z.Zones, domainID)
+	z.mu.Unlock()
+}
+
+// Lookup reports whether name has records in domain and whether records exist
+// below it, loading the zone's index when it is missing or older than the
+// zone's negative TTL. An index that fails to reload keeps being used, err is
+// only set when the zone has none
+func (z *ZoneNameMap) Lookup(name string, domain Domain) (exists, below bool, err error) {
+	ttl := time.Duration(domain.withSOADefaults().negativeSOA().Hdr.Ttl) * time.Second
+
+	z.mu.Lock()
+	index, ok := z.Zones[domain.ID]
+	fresh := ok && time.Since(index.loaded) < ttl
+	z.mu.Unlock()
+
+	if !fresh {
+		_, err = mysqlLookups.Do(fmt.Sprintf("names/%d", domain.ID), func() (interface{}, error) {
+			names, err := getZoneNames(domain.ID)
+			if err != nil {
+				z.backoff(domain.ID, ttl)
+				return nil, err
+			}
+			z.Store(domain.ID, names)
+			return nil, nil
+		})
+		if err != nil && !ok {
+			return false, false, err
+		} else if err != nil {
+			logger("dns").Warning(fmt.Sprintf("Using old name index of %s: %s", domain.Name, err.Error()))
+		}
+	}
+
+	if name == "" {
+		name = apexName
+	}
+	name = strings.ToLower(name)
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if index, ok = z.Zones[domain.ID]; !ok {
+		// forgotten while loading, the next query loads it again
+		return false, false, errZoneNotIndexed
+	}
+	return index.names[name], index.below[name], nil
+}
+
+// nameState reports whether name has records in domain and whether records
+// exist below it, from the zone's name index or from MySQL when the zone
+// can't be indexed
+func nameState(name string, domain Domain) (exists, below bool, err error) {
+	if exists, below, err = zoneNames.Lookup(name, domain); err == nil {
+		return exists, below, nil
+	}
+
+	set, err := getCachedRecords(name, domain)
+	if err != nil {
+		return false, false, err
+	}
+	below, err = hasRecordsBelow(name, domain.ID)
+	return len(set) > 0, below, err
+}